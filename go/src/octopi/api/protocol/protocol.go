@@ -2,6 +2,13 @@
 // and registers use to communicate with each other.
 package protocol
 
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
 // URL endpoints
 const (
 	// for brokers
@@ -9,8 +16,20 @@ const (
 	SUBSCRIBE = "subscribe" // consumer -> broker
 	FOLLOW    = "follow"    // follower -> leader
 	SWAP      = "swap"      // register -> broker
+	THROTTLE  = "throttle"  // admin -> broker, plain http
+	TRANSFER  = "transfer"  // admin -> broker, plain http
 	// for register
-	LEADER = "leader" // leader -> register
+	LEADER       = "leader"       // leader -> register
+	JOIN         = "join"         // broker -> register
+	VOTE         = "vote"         // register -> register
+	APPEND       = "append"       // register -> register
+	SNAPSHOT     = "snapshot"     // register -> register
+	STATUS       = "status"       // admin -> register, plain http
+	HISTORY      = "history"      // admin -> register, plain http
+	LOSSES       = "losses"       // admin -> register, plain http
+	METADATA     = "metadata"     // client -> register
+	DECOMMISSION = "decommission" // admin -> register, plain http
+	RECOMMISSION = "recommission" // admin -> register, plain http
 )
 
 // Status codes
@@ -21,40 +40,245 @@ const (
 	StatusFailure  = 400 // failed operation
 )
 
-// Register add or remove a follower
+// Register add or remove a follower, leader heartbeat, or leadership handoff
 const (
 	ADD = iota
 	REMOVE
+	HEARTBEAT
+	HANDOFF
 )
 
+// Separator between topic name and partition in partition names.
+const PARTITION_SEP = "#"
+
+// PartitionName returns the name of the given partition of a topic. Each
+// partition is stored in a log of that name, and has its own leader. Partition
+// 0 is named after the topic itself, so that logs created before topics were
+// partitioned remain readable.
+func PartitionName(topic string, partition int) string {
+	if 0 == partition {
+		return topic
+	}
+	return fmt.Sprintf("%s%s%d", topic, PARTITION_SEP, partition)
+}
+
+// ParsePartition returns the topic and partition of the given partition name.
+// It is the inverse of PartitionName.
+func ParsePartition(name string) (string, int) {
+	i := strings.LastIndex(name, PARTITION_SEP)
+	if i < 0 {
+		return name, 0
+	}
+	partition, err := strconv.Atoi(name[i+len(PARTITION_SEP):])
+	if nil != err || partition <= 0 {
+		return name, 0
+	}
+	return name[0:i], partition
+}
+
+// Separator between addresses in lists of registers.
+const REGISTER_SEP = ","
+
+// Registers returns the host:ports in the given comma-separated list of the
+// registers in a register cluster.
+func Registers(list string) []string {
+	registers := make([]string, 0)
+	for _, hostport := range strings.Split(list, REGISTER_SEP) {
+		if hostport = strings.TrimSpace(hostport); "" != hostport {
+			registers = append(registers, hostport)
+		}
+	}
+	return registers
+}
+
+// Default offset from the port of a broker of the port of the register embedded
+// in it, when brokers run without a separate register.
+const STATIC_REGISTER_OFFSET = 1000
+
+// StaticRegister returns the host:port of the register embedded in the broker
+// at the given host:port, which listens on the port of the broker plus the
+// given offset, when brokers are configured with a static list of peers
+// instead of registers.
+func StaticRegister(broker string, offset int) string {
+	host, port, err := net.SplitHostPort(broker)
+	if nil != err {
+		return broker
+	}
+	n, err := strconv.Atoi(port)
+	if nil != err {
+		return broker
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+offset))
+}
+
+// NextRegister returns the register that follows the given one in the list of
+// registers, wrapping around at the end. Returns the given register if it is
+// not in the list.
+func NextRegister(registers []string, current string) string {
+	for i, hostport := range registers {
+		if hostport == current {
+			return registers[(i+1)%len(registers)]
+		}
+	}
+	return current
+}
+
+// JoinRequests are sent by brokers to the register when they start. The
+// register replies with an Ack carrying the names of all known partitions, and
+// keeps the connection open for as long as the broker is alive.
+type JoinRequest struct {
+	HostPort   HostPort // hostport of the broker
+	Partitions []string // partitions stored by the broker
+}
+
 // FollowRequests are sent by brokers to registers/leaders when they wish to
-// join the broker set.
+// follow the leader of a partition.
 type FollowRequest struct {
-	Offsets  map[string]int64 // high watermarks of each topic log
-	HostPort HostPort         // hostport of the follower
+	Partition string                     // name of partition
+	Offsets   map[string]int64           // high watermarks of each topic log
+	Epochs    map[string][]EpochBoundary // epoch boundaries of each topic log
+	HostPort  HostPort                   // hostport of the follower
+	Epoch     int64                      // latest leader epoch seen by the follower
+}
+
+// EpochBoundaries mark the offset of the first message written to a log in a
+// leader epoch.
+type EpochBoundary struct {
+	Epoch  int64 // leader epoch
+	Offset int64 // offset of first message in epoch
 }
 
 // FollowACKs are sent from leaders to followers in response to follow
 // requests.
 type FollowACK struct {
 	Truncate map[string]int64
+	Epoch    int64 // leader epoch of the leader
+}
+
+// LeaderRequests are sent by brokers to the register when they wish to become
+// the leader of a partition. The register replies with an Ack carrying the new
+// leader epoch.
+type LeaderRequest struct {
+	Partition string   // name of partition
+	HostPort  HostPort // hostport of the broker
+	Epoch     int64    // latest leader epoch seen by the broker
+}
+
+// LeaderChanges are sent by the register to brokers when a partition needs a
+// new leader. Each election is a round with its own generation. Each broker
+// acknowledges receipt by replying with the LogState of its log of the
+// partition, and the register then sends the LeaderChange again with the
+// elected leader filled in, which brokers acknowledge with an ElectionAck.
+type LeaderChange struct {
+	Partition  string          // name of partition
+	Candidates map[string]bool // set of in-sync followers
+	Leader     string          // elected leader; empty until elected
+	Generation int64           // round of election; increases with every round
+}
+
+// ElectionAcks are sent by brokers to the register once they learn the outcome
+// of a round of election, and state the role that they are about to take.
+type ElectionAck struct {
+	Generation int64 // round of election
+	Leader     bool  // true iff the broker is about to lead the partition
+}
+
+// LogStates describe how up-to-date a broker's log of a partition is.
+type LogState struct {
+	Epoch int64 // leader epoch in which the last entry was written
+	Tail  int64 // size of the log
+}
+
+// VoteRequests are sent by registers that are candidates to lead the register
+// cluster.
+type VoteRequest struct {
+	Term      int64  // term of the candidate
+	Candidate string // host:port of the candidate
+	LastIndex int64  // index of the candidate's last entry
+	LastTerm  int64  // term of the candidate's last entry
+}
+
+// VoteReplies are sent in response to vote requests.
+type VoteReply struct {
+	Term    int64 // term of the voter
+	Granted bool  // true iff the vote was granted
+}
+
+// AppendRequests are sent by the leader of the register cluster to replicate
+// entries to the other registers, and as heartbeats.
+type AppendRequest struct {
+	Term      int64           // term of the leader
+	Leader    string          // host:port of the leader
+	PrevIndex int64           // index of the entry preceding the new ones
+	PrevTerm  int64           // term of the entry preceding the new ones
+	Entries   []RegisterEntry // new entries
+	Commit    int64           // commit index of the leader
+}
+
+// AppendReplies are sent in response to append requests.
+type AppendReply struct {
+	Term    int64 // term of the follower
+	Success bool  // true iff the entries were appended
+	Index   int64 // index of the last entry known to match the leader's
+}
+
+// SnapshotRequests are sent by the leader of the register cluster to registers
+// that are missing entries that it has compacted into a snapshot. Registers
+// reply with an AppendReply.
+type SnapshotRequest struct {
+	Term     int64  // term of the leader
+	Leader   string // host:port of the leader
+	Index    int64  // index of the last entry in the snapshot
+	LastTerm int64  // term of the last entry in the snapshot
+	State    []byte // register state as of the index
+}
+
+// RegisterEntries are entries of the replicated register log.
+type RegisterEntry struct {
+	Term    int64           // term in which the entry was created
+	Command RegisterCommand // change to register state
+}
+
+// RegisterCommands are changes to the state of the register, which are applied
+// in the same order on every register.
+type RegisterCommand struct {
+	Op         string           // operation
+	Partition  string           // partition, if any
+	HostPort   string           // broker, if any
+	Epoch      int64            // leader epoch, if any
+	Partitions []string         // partitions of a joining broker
+	Time       int64            // unix time in ms at which the change was proposed
+	Tail       int64            // tail of a leader elected uncleanly
+	Tails      map[string]int64 // longer tails lost in an unclean election
 }
 
 // Hostports are string representations of TCP addresses.
 type HostPort string
 
 // InsyncChanges are used by Leaders to contact the register whether
-// to add or remove a hostport from the list of in-sync followers
+// to add or remove a hostport from the list of in-sync followers of the
+// partition that they lead. Leaders also send them as heartbeats, which the
+// register answers with an Ack, and to hand leadership to the given follower.
 type InsyncChange struct {
 	Type     int
 	HostPort HostPort
+	Epoch    int64 // leader epoch of the leader
+	Tail     int64 // size of the leader's log, on heartbeats
 }
 
-// Syncs are sent from leaders to followers.
+// Syncs are sent from leaders to followers. Each carries either a single
+// message, or a chunk of whole log entries for followers that are far behind.
+// Idle followers are sent heartbeats, which carry only the high watermark.
 type Sync struct {
-	Topic     string  // topic
-	Message   Message // message
-	RequestId []byte  // sha256 of producer seqnum
+	Topic      string          // topic
+	Message    Message         // message
+	RequestId  []byte          // sha256 of producer seqnum
+	Epoch      int64           // leader epoch of the leader
+	EntryEpoch int64           // leader epoch in which the message was written
+	Committed  int64           // high watermark of the leader's log
+	Chunk      []byte          // raw log entries, if a bulk transfer
+	Boundaries []EpochBoundary // epoch boundaries within the chunk
+	Heartbeat  bool            // true iff the sync carries no entries
 }
 
 // SyncACKs are sent from followers to leaders after receiving sync messages
@@ -68,27 +292,75 @@ type SyncACK struct {
 type Ack struct {
 	Status  int    // status code
 	Payload []byte // payload
+	Epoch   int64  // leader epoch known to the sender, if any
+}
+
+// MetadataRequests are sent from clients to the register to learn about the
+// cluster. The register replies with an Ack carrying Metadata.
+type MetadataRequest struct {
+	Topics []string // topics to describe; all topics if empty
+}
+
+// Metadata describes the brokers of a cluster and its partitions, so that
+// clients can find leaders without being redirected by the register.
+type Metadata struct {
+	Brokers    []HostPort          // live brokers
+	Partitions []PartitionMetadata // partitions, sorted by name
+}
+
+// PartitionMetadata describes the leadership of a partition. The tail is as
+// last reported by the leader, at most a heartbeat interval ago.
+type PartitionMetadata struct {
+	Topic     string
+	Partition int
+	Leader    HostPort   // empty if there is none
+	Epoch     int64      // leader epoch
+	Insync    []HostPort // in-sync followers
+	Tail      int64      // size of the leader's log
 }
 
 // ProduceRequests are sent from producers to brokers when they want to send
-// messages under a specific topic.
+// messages under a specific topic. A batch of messages may be sent instead of
+// a single one. The broker acknowledges both with a ProduceReceipt.
 type ProduceRequest struct {
-	ID      string // id of producer
-	Topic   string
-	Message Message
+	ID        string // id of producer
+	Topic     string
+	Partition int // partition of topic
+	Message   Message
+	Messages  []Message // batch of messages; Message is ignored if not empty
+}
+
+// ProduceReceipts are the payloads of produce acknowledgements, and state where
+// the messages were written.
+type ProduceReceipt struct {
+	Topic     string
+	Partition int
+	Offsets   []int64 // offset of the message, or of each message of a batch
+}
+
+// Positions locate a message in a partition of a topic. Subscribing at the
+// offset of a position replays the topic from that message.
+type Position struct {
+	Topic     string
+	Partition int
+	Offset    int64
 }
 
 // SubscribeRequests are sent from consumers to brokers when they want messages
-// from a particular topic.
+// from a particular topic. Consumers only receive committed messages unless
+// they ask for uncommitted ones.
 type SubscribeRequest struct {
-	Topic  string
-	Offset int64 // optional
+	Topic       string
+	Partition   int   // optional
+	Offset      int64 // optional
+	Uncommitted bool  // optional; read past the high watermark
 }
 
 // Messages sent from producers to brokers; the enclosed payload is broadcast
 // to all consumers subscribing to the topic.
 type Message struct {
-	ID       int64  // seq num from producer, or offset from broker
-	Payload  []byte // message contents
-	Checksum uint32 // crc32 checksum
+	ID       int64             // seq num from producer, or offset from broker
+	Payload  []byte            // message contents
+	Checksum uint32            // crc32 checksum
+	Headers  map[string]string // optional; stored and delivered with the message
 }
@@ -23,15 +23,26 @@ const MAX_RETRY_INTERVAL = 2000
 // been exceeded.
 var ABORT = errors.New("Exceeded maximum number of attempts.")
 
+// STALE is the error returned when a message is stamped with a leader epoch
+// that is older than one already seen.
+var STALE = errors.New("Leader epoch is out of date.")
+
+// REFUSED is the error returned by Send when the target responds with a
+// failure status.
+var REFUSED = errors.New("Request was refused.")
+
 // Websocket protocol prefix
 const ws = "ws://"
 
 type Socket struct {
-	HostPort string          // host:port of target node
-	Path     string          // target url that is serving ws requests
-	Origin   string          // source origin (See websockets spec)
-	Conn     *websocket.Conn // websocket connection
-	lock     sync.Mutex      // lock
+	HostPort  string          // host:port of target node
+	Path      string          // target url that is serving ws requests
+	Origin    string          // source origin (See websockets spec)
+	Conn      *websocket.Conn // websocket connection
+	Epoch     int64           // latest leader epoch acknowledged
+	Registers []string        // registers to fail over between, if any
+	Timeout   time.Duration   // max time to wait for a message; 0 waits forever
+	lock      sync.Mutex      // lock
 }
 
 // Reset resets the sockets HostPort to the given address. This closes the
@@ -62,8 +73,11 @@ func (s *Socket) close() error {
 
 // Send sends the request to the given endpoint, and keeps trying until it
 // succeeds or exceeds the maximum number of retries. If it encounters a
-// redirect, the enclosed hostport is used as to find the new endpoint. Returns
+// redirect, the enclosed hostport is used as to find the new endpoint. If a
+// register cannot be reached, the next one in Registers is tried. Returns
 // a channel that can be used to receive messages if there are no errors.
+// Acknowledgements from leaders with an out-of-date epoch are rejected with
+// STALE.
 func (s *Socket) Send(request interface{}, attempts int, origin string) ([]byte, error) {
 
 	s.lock.Lock()
@@ -81,6 +95,7 @@ func (s *Socket) Send(request interface{}, attempts int, origin string) ([]byte,
 		err := s.send(endpoint, request)
 		if nil != err {
 			log.Warn("Unable to open connection with %s: %s", endpoint, err.Error())
+			s.HostPort = NextRegister(s.Registers, s.HostPort)
 			s.backoff()
 			continue
 		}
@@ -94,9 +109,16 @@ func (s *Socket) Send(request interface{}, attempts int, origin string) ([]byte,
 			// interpret status
 			switch ack.Status {
 			case StatusFailure:
+				log.Warn("%s responded with failure status.", endpoint)
 				s.close()
-				return nil, fmt.Errorf("%s responded with failure status.", endpoint)
+				return nil, REFUSED
 			case StatusSuccess:
+				if ack.Epoch < s.Epoch {
+					log.Warn("%s has stale epoch %d.", endpoint, ack.Epoch)
+					s.close()
+					return nil, STALE
+				}
+				s.Epoch = ack.Epoch
 				return ack.Payload, nil
 			case StatusRedirect:
 				log.Debug("Redirected to %s.", ack.Payload)
@@ -163,8 +185,8 @@ func (s *Socket) Receive(value interface{}) error {
 
 }
 
-// receive waits on the connection for a single message. Caller must have
-// socket lock before invoking this.
+// receive waits on the connection for a single message, for at most the
+// timeout if one is set. Caller must have socket lock before invoking this.
 func (s *Socket) receive(value interface{}) error {
 
 	if nil == s.Conn {
@@ -177,14 +199,19 @@ func (s *Socket) receive(value interface{}) error {
 
 	for {
 
+		if s.Timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.Timeout))
+		}
+
 		err := websocket.JSON.Receive(conn, value)
 
 		switch err {
 		case nil:
 			return nil
 		default:
+			// the other end has gone quiet for too long
 			e, ok := err.(net.Error)
-			if ok && e.Temporary() {
+			if ok && e.Temporary() && !e.Timeout() {
 				continue
 			}
 		}
@@ -54,7 +54,7 @@ func TestRetries(tester *testing.T) {
 
 func redirect(requestCount *int) func(*websocket.Conn) {
 	return func(conn *websocket.Conn) {
-		ack := &Ack{StatusRedirect, []byte("localhost:11112")}
+		ack := &Ack{Status: StatusRedirect, Payload: []byte("localhost:11112")}
 		websocket.JSON.Send(conn, ack)
 		*requestCount++
 	}
@@ -63,7 +63,7 @@ func redirect(requestCount *int) func(*websocket.Conn) {
 func accept(requestCount *int) func(*websocket.Conn) {
 	return func(conn *websocket.Conn) {
 		*requestCount++
-		ack := &Ack{StatusSuccess, make([]byte, 0)}
+		ack := &Ack{Status: StatusSuccess, Payload: make([]byte, 0)}
 		websocket.JSON.Send(conn, ack)
 		for {
 			var request interface{}
@@ -110,7 +110,7 @@ func TestRedirects(tester *testing.T) {
 
 func fail(requestCount *int) func(*websocket.Conn) {
 	return func(conn *websocket.Conn) {
-		ack := &Ack{StatusFailure, nil}
+		ack := &Ack{Status: StatusFailure}
 		websocket.JSON.Send(conn, ack)
 		*requestCount += 1
 	}
@@ -144,6 +144,43 @@ func TestFailure(tester *testing.T) {
 
 }
 
+func stale(epoch int64) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		ack := &Ack{Status: StatusSuccess, Epoch: epoch}
+		websocket.JSON.Send(conn, ack)
+	}
+}
+
+// TestStaleEpoch ensures that Send rejects acknowledgements from leaders with
+// an older epoch.
+func TestStaleEpoch(tester *testing.T) {
+
+	t := test.New(tester)
+
+	listener, err := net.Listen("tcp", ":11111")
+	t.AssertNil(err, "net.Listen")
+
+	server := &http.Server{
+		Handler: websocket.Handler(stale(1)),
+	}
+
+	go server.Serve(listener)
+
+	socket := &Socket{
+		HostPort: "localhost:11111",
+		Path:     "",
+		Origin:   "localhost:12345",
+		Epoch:    2,
+	}
+	_, err = socket.Send(nil, 3, fakeOrigin)
+	listener.Close()
+
+	if STALE != err {
+		tester.Errorf("Expected STALE, was %v.", err)
+	}
+
+}
+
 // TestResetSend ensures that Sends are interrupted.
 func TestResetSend(tester *testing.T) {
 
@@ -260,3 +297,61 @@ func TestReceive(tester *testing.T) {
 	listener.Close()
 
 }
+
+// TestFailover ensures that the socket moves on to the next register if a
+// register cannot be reached.
+func TestFailover(tester *testing.T) {
+
+	t := test.New(tester)
+	requestCount := 0
+
+	listener, err := net.Listen("tcp", ":11115")
+	t.AssertNil(err, "net.Listen")
+
+	server := &http.Server{Handler: websocket.Handler(accept(&requestCount))}
+	go server.Serve(listener)
+
+	socket := &Socket{
+		HostPort:  "localhost:11114",
+		Path:      "",
+		Origin:    "localhost:12345",
+		Registers: []string{"localhost:11114", "localhost:11115"},
+	}
+	_, err = socket.Send(nil, 3, fakeOrigin)
+	t.AssertNil(err, "socket.Send")
+
+	listener.Close()
+	t.AssertEqual(new(test.IntMatcher), 1, requestCount)
+	t.AssertEqual(new(test.StringMatcher), "localhost:11115", socket.HostPort)
+
+}
+
+// TestTimeout ensures that Receive gives up on a connection that stays quiet
+// for longer than the timeout.
+func TestTimeout(tester *testing.T) {
+
+	t := test.New(tester)
+	requestCount := 0
+
+	listener, err := net.Listen("tcp", ":11111")
+	t.AssertNil(err, "net.Listen")
+
+	server := &http.Server{Handler: websocket.Handler(accept(&requestCount))}
+	go server.Serve(listener)
+	defer listener.Close()
+
+	socket := &Socket{
+		HostPort: "localhost:11111",
+		Path:     "",
+		Origin:   "localhost:12345",
+		Timeout:  200 * time.Millisecond,
+	}
+	_, err = socket.Send(new(Ack), 3, fakeOrigin)
+	t.AssertNil(err, "socket.Send")
+
+	start := time.Now()
+	var ack Ack
+	t.AssertNotNil(socket.Receive(&ack), "socket.Receive")
+	t.AssertTrue(time.Since(start) < 2*time.Second, "socket.Receive")
+
+}
@@ -69,7 +69,7 @@ func (tp *TwitProducer) RelayMessages() error {
 			continue
 		}
 
-		if err := tp.producer.Send(TOPIC, []byte(tweet)); nil != err {
+		if _, err := tp.producer.Send(TOPIC, []byte(tweet)); nil != err {
 			fmt.Printf("Connection lost.\n")
 			return err
 		}
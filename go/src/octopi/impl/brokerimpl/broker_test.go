@@ -4,10 +4,14 @@ import (
 	"code.google.com/p/go.net/websocket"
 	"net"
 	"net/http"
+	"octopi/api/protocol"
 	"octopi/util/config"
+	"octopi/util/test"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const testRegisterPort = "11111"
@@ -16,7 +20,6 @@ const testSocketPort = "11112"
 // newTestConfig creates a new test configuration.
 func newTestConfig() *Config {
 	options := &config.Config{Options: make(map[string]string), Base: "/"}
-	options.Options["role"] = "leader"
 	options.Options["log_dir"] = os.TempDir()
 	options.Options["register"] = "localhost:" + testRegisterPort
 	return &Config{*options}
@@ -33,8 +36,34 @@ func newTestRegister() net.Listener {
 	return listener
 }
 
-// testRegister takes websocket connections.
+// testRegister takes websocket connections, reports no partitions to brokers
+// that join, and grants leadership to any broker that asks for it.
 func testRegister(conn *websocket.Conn) {
+	switch conn.Request().URL.Path {
+	case "/" + protocol.JOIN:
+		var request protocol.JoinRequest
+		if err := websocket.JSON.Receive(conn, &request); nil != err {
+			return
+		}
+		ack := &protocol.Ack{Status: protocol.StatusSuccess, Payload: []byte("[]")}
+		websocket.JSON.Send(conn, ack)
+		// hold the connection open until the broker goes away
+		websocket.JSON.Receive(conn, &request)
+	case "/" + protocol.LEADER:
+		var request protocol.LeaderRequest
+		if err := websocket.JSON.Receive(conn, &request); nil != err {
+			return
+		}
+		ack := &protocol.Ack{Status: protocol.StatusSuccess, Epoch: request.Epoch + 1}
+		websocket.JSON.Send(conn, ack)
+		// answer heartbeats until the leader goes away
+		var change protocol.InsyncChange
+		for nil == websocket.JSON.Receive(conn, &change) {
+			if protocol.HEARTBEAT == change.Type {
+				websocket.JSON.Send(conn, ack)
+			}
+		}
+	}
 }
 
 // TestTails checks that the tails function returns the sizes of all log files.
@@ -74,3 +103,181 @@ func TestTails(t *testing.T) {
 	}
 
 }
+
+// TestLease ensures that leaders keep their lease while the register answers
+// heartbeats, and stop accepting writes and step down once it expires.
+func TestLease(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	config.Options["heartbeat_interval"] = "50"
+	config.Options["lease_timeout"] = "200"
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	t.AssertNil(broker.BecomeLeader("lease"), "BecomeLeader")
+	defer os.Remove(filepath.Join(config.LogDir(), "lease"+EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "lease"+EPOCHS_EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "lease"+WATERMARK_EXT))
+
+	time.Sleep(400 * time.Millisecond)
+	_, err = broker.Publish("lease", 0, "x", &protocol.Message{ID: 1})
+	t.AssertNil(err, "Publish")
+
+	// cut the leader off from the register, so that the lease is not renewed
+	broker.lock.Lock()
+	r := broker.replica("lease")
+	r.regConn = nil
+	r.lease = time.Now()
+	broker.lock.Unlock()
+
+	_, err = broker.Publish("lease", 0, "x", &protocol.Message{ID: 2})
+	t.AssertTrue(NOT_LEADER == err, "Publish")
+
+	time.Sleep(100 * time.Millisecond)
+	broker.lock.Lock()
+	t.AssertTrue(FOLLOWER == r.role, "r.role")
+	broker.lock.Unlock()
+
+}
+
+// TestLeaseDuringPublish ensures that a publish that is waiting for followers
+// when the lease expires is not acknowledged.
+func TestLeaseDuringPublish(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	config.Options["heartbeat_interval"] = "50"
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	t.AssertNil(broker.BecomeLeader("expiry"), "BecomeLeader")
+	defer os.Remove(filepath.Join(config.LogDir(), "expiry"+EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "expiry"+EPOCHS_EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "expiry"+WATERMARK_EXT))
+
+	client, listener := newTestClient(t, func(conn *websocket.Conn) {})
+	defer client.Close()
+	defer listener.Close()
+
+	// the follower never acknowledges
+	follower := newTestFollower()
+	follower.conn = client
+	broker.lock.Lock()
+	r := broker.replica("expiry")
+	follower.replica = r
+	r.followers[follower] = true
+	broker.lock.Unlock()
+
+	published := make(chan error, 1)
+	go func() {
+		_, err := broker.Publish("expiry", 0, "x", &protocol.Message{ID: 1})
+		published <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	broker.lock.Lock()
+	r.regConn = nil
+	r.lease = time.Now()
+	broker.lock.Unlock()
+
+	t.AssertTrue(NOT_LEADER == <-published, "Publish")
+
+	topic, err := broker.topic("expiry")
+	t.AssertNil(err, "broker.topic")
+	t.AssertEqual(new(test.IntMatcher), 0, int(topic.hw.Offset()))
+
+}
+
+// TestElectionRounds ensures that brokers ignore rounds of election that are
+// older than the latest round seen.
+func TestElectionRounds(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	t.AssertTrue(broker.JoinElection("rounds", 2), "JoinElection")
+	t.AssertTrue(broker.LatestElection("rounds", 2), "LatestElection")
+	t.AssertTrue(!broker.JoinElection("rounds", 1), "JoinElection")
+	t.AssertTrue(broker.JoinElection("rounds", 3), "JoinElection")
+	t.AssertTrue(!broker.LatestElection("rounds", 2), "LatestElection")
+
+}
+
+// TestPublishBatch ensures that batches are written in order, that the offset
+// of each message is returned, and that topics named like partitions are
+// refused.
+func TestPublishBatch(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	t.AssertNil(broker.BecomeLeader("batch"), "BecomeLeader")
+	defer os.Remove(filepath.Join(config.LogDir(), "batch"+EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "batch"+EPOCHS_EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "batch"+WATERMARK_EXT))
+
+	batch := []protocol.Message{{ID: 1}, {ID: 2}, {ID: 3}}
+	offsets, err := broker.PublishBatch("batch", 0, "x", batch)
+	t.AssertNil(err, "PublishBatch")
+	t.AssertEqual(new(test.IntMatcher), 3, len(offsets))
+	t.AssertEqual(new(test.IntMatcher), 0, int(offsets[0]))
+	t.AssertTrue(offsets[0] < offsets[1] && offsets[1] < offsets[2], "offsets")
+
+	// resending the batch does not write it again
+	again, err := broker.PublishBatch("batch", 0, "x", batch)
+	t.AssertNil(err, "PublishBatch")
+	for i := range batch {
+		t.AssertEqual(new(test.IntMatcher), int(offsets[i]), int(again[i]))
+	}
+
+	// nor does it mark an epoch boundary if it is resent in a later epoch
+	topic, err := broker.topic("batch")
+	t.AssertNil(err, "broker.topic")
+	boundaries := len(topic.boundaries())
+	_, _, err = topic.publishBatch("x", batch, broker.Epoch("batch", 0)+1)
+	t.AssertNil(err, "topic.publishBatch")
+	t.AssertEqual(new(test.IntMatcher), boundaries, len(topic.boundaries()))
+
+	// a message from an earlier batch is refused, and nothing is written
+	_, err = broker.PublishBatch("batch", 0, "x", []protocol.Message{{ID: 4}})
+	t.AssertNil(err, "PublishBatch")
+	tail, err := topic.tail()
+	t.AssertNil(err, "topic.tail")
+
+	_, err = broker.PublishBatch("batch", 0, "x", []protocol.Message{{ID: 5}, batch[1]})
+	t.AssertTrue(OUT_OF_ORDER == err, "PublishBatch")
+	same, err := topic.tail()
+	t.AssertNil(err, "topic.tail")
+	t.AssertEqual(new(test.IntMatcher), int(tail), int(same))
+
+	// messages of other producers are written
+	_, err = broker.PublishBatch("batch", 0, "y", batch[1:2])
+	t.AssertNil(err, "PublishBatch")
+	longer, err := topic.tail()
+	t.AssertNil(err, "topic.tail")
+	t.AssertTrue(longer > tail, "tail")
+
+	// topics may not be named like partitions of other topics
+	_, err = broker.PublishBatch("batch"+protocol.PARTITION_SEP+"1", 0, "x", batch)
+	t.AssertNotNil(err, "PublishBatch")
+	_, err = broker.Subscribe(nil, "batch"+protocol.PARTITION_SEP+"1", 0, 0, false)
+	t.AssertNotNil(err, "Subscribe")
+
+}
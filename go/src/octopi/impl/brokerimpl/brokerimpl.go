@@ -16,21 +16,30 @@ import (
 	"time"
 )
 
-// Brokers relay messages from producers to followers. One broker is a leader,
-// and the others are followers.
+// Brokers relay messages from producers to followers. Each partition has one
+// leader, and the other brokers follow it. A broker may lead some partitions
+// and follow others, so that writes are spread across the broker set.
 type Broker struct {
-	config        *Config
-	role          int                        // leader or follower
-	followers     map[*Follower]bool         // set of followers
-	subscriptions map[string]SubscriptionSet // map of topics to consumer connections
-	logs          map[string]*Log            // map of topics to logs
-	leader        *protocol.Socket           // connection to the leader
-	checkpoints   map[string]int64           // checkpoints for each topic log
-	regConn       *websocket.Conn            // connection to the register, used by leader
-	lock          sync.Mutex                 // lock to manage broker access
-	cond          *sync.Cond                 // conditional variable for message log
+	config   *Config
+	replicas map[string]*Replica // map of partitions to replication state
+	topics   map[string]*Topic   // map of topic names to topics
+	member   *protocol.Socket    // connection to the register, held while alive
+	lagging  *Throttle           // limits traffic to followers catching up
+	steady   *Throttle           // limits traffic to in-sync followers
+	lock     sync.Mutex          // lock to manage broker access
 }
 
+// Time in ms between checks of follower lag.
+const LAG_CHECK_INTERVAL = 500
+
+// NOT_LEADER is the error returned when a broker is asked to publish to a
+// partition that it does not lead.
+var NOT_LEADER = errors.New("I am not the leader.")
+
+// NO_REGISTER is the error returned when the register cannot be told about a
+// partition, because the leader connection of the partition is down.
+var NO_REGISTER = errors.New("No connection to the register.")
+
 // SubscriptionSet implemented as a map from *Subscription to true.
 type SubscriptionSet map[*Subscription]bool
 
@@ -40,46 +49,30 @@ type FollowerSet map[*Follower]bool
 // Offsets implemented as a map from topics to file sizes.
 type Offsets map[string]int64
 
-// New takes the host:port of the registry/leader and creates a new broker.
+// New takes the host:port of the registry and creates a new broker. The broker
+// joins the register, which decides which partitions it leads.
 // Options:
-// - register: host:port of registry/leader
+// - register: host:port of registry, or comma-separated list of registers
 func New(options *config.Config) (*Broker, error) {
 
 	config := &Config{*options}
 	b := &Broker{
-		role:          config.Role(),
-		config:        config,
-		checkpoints:   make(map[string]int64),
-		followers:     make(FollowerSet),
-		subscriptions: make(map[string]SubscriptionSet),
-		logs:          make(map[string]*Log),
+		config:   config,
+		replicas: make(map[string]*Replica),
+		topics:   make(map[string]*Topic),
+		lagging:  NewThrottle(config.CatchUpRate()),
+		steady:   NewThrottle(config.ReplicationRate()),
 	}
 
-	b.cond = sync.NewCond(&b.lock)
 	b.initLogs()
-	b.initSocket()
 
-	switch b.role {
-	case FOLLOWER:
-		return b, b.register()
-	case LEADER:
-		return b, b.BecomeLeader()
-	}
-
-	return nil, errors.New("Invalid configuration options.")
+	go b.monitorFollowers()
+	go b.heartbeat()
+	return b, b.join()
 
 }
 
-// initSocket initializes the socket to use to connect to the leader.
-func (b *Broker) initSocket() {
-	b.leader = &protocol.Socket{
-		HostPort: b.config.Register(),
-		Path:     protocol.FOLLOW,
-		Origin:   b.Origin(),
-	}
-}
-
-// initLogs initializes the logs map.
+// initLogs initializes the topics map from the log files in the log directory.
 func (b *Broker) initLogs() {
 
 	pattern := filepath.Join(b.config.LogDir(), "*"+EXT)
@@ -93,148 +86,570 @@ func (b *Broker) initLogs() {
 		topic := filepath.Base(name)
 		topic = topic[0 : len(topic)-len(EXT)]
 
-		file, err := OpenLog(b.config, topic, -1)
-
-		if nil != err {
+		if _, err := b.topic(topic); nil != err {
 			log.Error("Ignoring bad log file: %s", name)
 			continue
 		}
 
-		b.logs[topic] = file
 		log.Info("Found log file for %s.", topic)
 
 	}
 
 }
 
-// ChangeLeader closes the current leader connection and re-registers.
-func (b *Broker) ChangeLeader() error {
+// join announces this broker and its partitions to the register, and follows
+// every partition known to the register. The register elects leaders for
+// partitions that do not have one, and notifies this broker if it is chosen.
+// The broker joins again whenever its connection to the register is lost.
+func (b *Broker) join() error {
+
+	b.member = &protocol.Socket{
+		HostPort:  b.config.Register(),
+		Path:      protocol.JOIN,
+		Origin:    b.Origin(),
+		Registers: b.config.Registers(),
+	}
+
+	if err := b.announce(); nil != err {
+		return err
+	}
+
+	go b.stay()
+	return nil
+
+}
+
+// stay joins the register again whenever the connection to it is lost, which
+// happens when the leading register fails or stops leading, or when this
+// broker is decommissioned. A decommissioned broker drains its consumers, and
+// keeps trying to join until it is recommissioned.
+func (b *Broker) stay() {
+
+	for {
+
+		var ignored interface{}
+		if err := b.member.Receive(&ignored); nil == err {
+			continue
+		}
+
+		log.Warn("Lost connection to register. Joining again.")
+		for {
+			err := b.announce()
+			if nil == err {
+				break
+			}
+			if protocol.REFUSED == err {
+				log.Warn("Register refused this broker, which has been decommissioned.")
+				b.drain()
+			}
+			backoff()
+		}
+
+	}
+
+}
+
+// drain closes the connections of all consumers, so that they subscribe to
+// other brokers through the register.
+func (b *Broker) drain() {
+
+	b.lock.Lock()
+	topics := make([]*Topic, 0, len(b.topics))
+	for _, t := range b.topics {
+		topics = append(topics, t)
+	}
+	b.lock.Unlock()
+
+	for _, t := range topics {
+		t.lock.Lock()
+		for subscription, _ := range t.subscriptions {
+			subscription.quit <- nil
+			subscription.conn.Close()
+			delete(t.subscriptions, subscription)
+		}
+		t.cond.Broadcast()
+		t.lock.Unlock()
+	}
+
+}
+
+// announce sends a join request to the register, and follows the partitions
+// that this broker does not know of yet.
+func (b *Broker) announce() error {
+
+	b.lock.Lock()
+	request := &protocol.JoinRequest{HostPort: protocol.HostPort(b.Origin())}
+	for name, _ := range b.topics {
+		request.Partitions = append(request.Partitions, name)
+	}
+	b.lock.Unlock()
+
+	payload, err := b.member.Send(request, math.MaxInt32, b.Origin())
+	if nil != err {
+		return err
+	}
+
+	var partitions []string
+	if err := json.Unmarshal(payload, &partitions); nil != err {
+		return err
+	}
 
-	b.leader.Reset(b.config.Register())
-	log.Info("Reset to be %v", b.config.Register())
+	log.Info("Joined register with partitions %v.", partitions)
 
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	return b.register()
+	for _, name := range partitions {
+		if _, exists := b.replicas[name]; !exists {
+			go b.follow(name)
+		}
+	}
+
+	return nil
 
 }
 
-// BecomeLeader returns only after successfully declaring leadership with the
-// register. It locks down the broker, declares leadership with the register,
-// and checkpoints the tails of all open logs.
-func (b *Broker) BecomeLeader() error {
+// follow follows the leader of the given partition, unless this broker is
+// already its leader.
+func (b *Broker) follow(name string) {
 
-	endpoint := "ws://" + b.config.Register() + "/" + protocol.LEADER
-	origin := b.Origin()
+	b.lock.Lock()
+	leading := LEADER == b.replica(name).role
+	b.lock.Unlock()
 
-	log.Debug("Resetting...")
-	b.leader.Reset(origin)
+	if leading {
+		return
+	}
+
+	if err := b.ChangeLeader(name); nil != err {
+		log.Warn("Unable to follow %s: %s", name, err.Error())
+	}
+
+}
+
+// ChangeLeader closes the current leader connection of the given partition,
+// and re-registers as a follower. If this broker was the leader of the
+// partition, it steps down.
+func (b *Broker) ChangeLeader(name string) error {
 
 	b.lock.Lock()
-	defer b.lock.Unlock()
+	r := b.replica(name)
+	if LEADER == r.role {
+		b.stepDown(r)
+	}
+	b.lock.Unlock()
+
+	r.leader.Reset(b.config.Register())
+	log.Info("Reset leader of %s to be %v", name, b.config.Register())
+
+	return b.register(r)
+
+}
 
+// BecomeLeader returns only after successfully declaring leadership of the
+// given partition with the register. The register issues a new leader epoch,
+// which is stamped on all messages sent by this leader. Returns an error if
+// the register already has a leader for the partition. A broker that already
+// leads the partition keeps its epoch.
+func (b *Broker) BecomeLeader(name string) error {
+
+	register := b.config.Register()
+	origin := b.Origin()
+
+	b.lock.Lock()
+	r := b.replica(name)
+	epoch := r.epoch
+	b.lock.Unlock()
+
+	log.Debug("Resetting...")
+	r.leader.Reset(origin)
+
+	var conn *websocket.Conn
+	var requested time.Time
 	for {
 
 		var err error
-		b.regConn, err = websocket.Dial(endpoint, "", origin)
+		endpoint := "ws://" + register + "/" + protocol.LEADER
+		conn, err = websocket.Dial(endpoint, "", origin)
 
 		if nil != err {
 			log.Warn("Error dialing %s: %s", endpoint, err.Error())
+			register = protocol.NextRegister(b.config.Registers(), register)
+			backoff()
+			continue
+		}
+
+		// the lease starts before the register can have granted it
+		requested = time.Now()
+		request := &protocol.LeaderRequest{name, protocol.HostPort(origin), epoch}
+		err = websocket.JSON.Send(conn, request)
+		if nil != err {
 			backoff()
 			continue
 		}
 
-		err = websocket.JSON.Send(b.regConn, origin)
+		var ack protocol.Ack
+		err = websocket.JSON.Receive(conn, &ack)
 		if nil != err {
 			backoff()
 			continue
 		}
 
+		switch ack.Status {
+		case protocol.StatusSuccess:
+		case protocol.StatusRedirect:
+			// only the leading register grants leadership
+			conn.Close()
+			register = string(ack.Payload)
+			continue
+		case protocol.StatusNotReady:
+			conn.Close()
+			backoff()
+			continue
+		default:
+			conn.Close()
+			return fmt.Errorf("Register refused leadership of %s at epoch %d.", name, ack.Epoch)
+		}
+
+		epoch = ack.Epoch
 		break
 
 	}
 
-	b.checkpoints = b.tails()
-	b.role = LEADER
+	// make sure the log exists, so that followers can catch up
+	if _, err := b.topic(name); nil != err {
+		conn.Close()
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if nil != r.regConn {
+		r.regConn.Close()
+	}
+
+	r.regConn = conn
+	r.epoch = epoch
+	r.role = LEADER
+	r.lease = requested.Add(b.config.LeaseTimeout())
+	r.beats = nil
+
+	go b.watchRegister(r, conn)
+
+	log.Info("Became leader of %s with epoch %d.", name, epoch)
 	return nil
 
 }
 
-// register sends a follow request to the given leader.
-func (b *Broker) register() error {
+// watchRegister renews the lease on the given partition whenever the register
+// acknowledges a heartbeat on the given connection, until the connection is
+// lost while leading, e.g. because the leading register failed or stopped
+// answering heartbeats.
+// Leadership is then reclaimed from the leading register; if it refuses, this
+// broker follows the new leader instead.
+func (b *Broker) watchRegister(r *Replica, conn *websocket.Conn) {
 
-	log.Info("In register()")
-	follow := &protocol.FollowRequest{b.tails(), protocol.HostPort(b.Origin())}
-	payload, err := b.leader.Send(follow, math.MaxInt32, b.Origin())
+	// the register answers every heartbeat, in order
+	for {
+
+		var ignored interface{}
+		conn.SetReadDeadline(time.Now().Add(b.config.SessionTimeout()))
+		if err := websocket.JSON.Receive(conn, &ignored); nil != err {
+			break
+		}
+
+		b.lock.Lock()
+		if r.regConn == conn && 0 != len(r.beats) {
+			r.lease = r.beats[0].Add(b.config.LeaseTimeout())
+			r.beats = r.beats[1:]
+		}
+		b.lock.Unlock()
+
+	}
+
+	b.lock.Lock()
+	lost := r.regConn == conn && LEADER == r.role
+	b.lock.Unlock()
+
+	if !lost {
+		return
+	}
+
+	log.Warn("Lost connection to register while leading %s.", r.name)
+	if err := b.BecomeLeader(r.name); nil != err {
+		log.Warn("Unable to reclaim leadership of %s: %s", r.name, err.Error())
+		if err := b.ChangeLeader(r.name); nil != err {
+			log.Warn("Unable to follow %s: %s", r.name, err.Error())
+		}
+	}
+
+}
+
+// register sends a follow request for the given partition to its leader.
+func (b *Broker) register(r *Replica) error {
+
+	log.Info("In register() for %s", r.name)
+
+	b.lock.Lock()
+	follow := &protocol.FollowRequest{
+		Partition: r.name,
+		Offsets:   make(Offsets),
+		Epochs:    make(map[string][]protocol.EpochBoundary),
+		HostPort:  protocol.HostPort(b.Origin()),
+		Epoch:     r.epoch,
+	}
+	if t, exists := b.topics[r.name]; exists {
+		if tail, err := t.tail(); nil == err {
+			follow.Offsets[r.name] = tail
+		}
+		follow.Epochs[r.name] = t.boundaries()
+	}
+	b.lock.Unlock()
+
+	payload, err := r.leader.Send(follow, math.MaxInt32, b.Origin())
 
 	if nil != err {
 		return err
 	}
 
-	log.Info("Registered with leader.")
+	log.Info("Registered with leader of %s.", r.name)
 
 	var ack protocol.FollowACK
 	if err := json.Unmarshal(payload, &ack); nil != err {
 		return err
 	}
 
-	for topic, checkpoint := range ack.Truncate {
-		if log, exists := b.logs[topic]; exists {
-			log.Close()
-			delete(b.logs, topic)
-		}
-		if err := truncateLog(b.config, topic, checkpoint); nil != err {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ack.Epoch < r.epoch {
+		return protocol.STALE
+	}
+
+	r.epoch = ack.Epoch
+	r.role = FOLLOWER
+
+	for topic, offset := range ack.Truncate {
+		log.Info("Truncating %s at %d.", topic, offset)
+		if err := b.truncate(topic, offset); nil != err {
 			return err
 		}
 	}
 
 	// successful connection
-	go b.failSafeCatchUp()
+	go b.failSafeCatchUp(r)
 
-	log.Info("Catching up with leader.")
+	log.Info("Catching up with leader of %s.", r.name)
 	return nil
 
 }
 
+// heartbeat periodically sends heartbeats to the register for every partition
+// that this broker leads, which carry the size of its log, and wakes up idle
+// followers so that they are sent heartbeats too. Leaders whose lease has
+// expired step down and follow the partition instead, since the register may
+// have elected another leader.
+func (b *Broker) heartbeat() {
+	for _ = range time.Tick(b.config.HeartbeatInterval()) {
+		b.lock.Lock()
+		for name, r := range b.replicas {
+			switch {
+			case LEADER != r.role:
+			case !r.leased():
+				log.Warn("Lease on %s has expired.", name)
+				b.stepDown(r)
+				go b.follow(name)
+			case nil != r.regConn:
+				r.beats = append(r.beats, time.Now())
+				beat := &protocol.InsyncChange{Type: protocol.HEARTBEAT}
+				if t, exists := b.topics[name]; exists {
+					beat.Tail, _ = t.tail()
+				}
+				b.notifyRegister(r, beat)
+			}
+			r.cond.Broadcast()
+		}
+		b.lock.Unlock()
+	}
+}
+
+// SetThrottles changes the rates, in bytes per second, at which logs are sent
+// to followers that are catching up and to in-sync followers. Rates that are
+// not positive remove the limit. Takes effect for transfers in progress.
+func (b *Broker) SetThrottles(catchUp int64, replication int64) {
+	b.lagging.SetRate(catchUp)
+	b.steady.SetRate(replication)
+	log.Info("Throttled catch-up to %d B/s and replication to %d B/s.", catchUp, replication)
+}
+
+// Throttles returns the rates, in bytes per second, at which logs are sent to
+// followers that are catching up and to in-sync followers.
+func (b *Broker) Throttles() (int64, int64) {
+	return b.lagging.Rate(), b.steady.Rate()
+}
+
 // tails returns the sizes of all log files, organized by their topics.
 func (b *Broker) tails() Offsets {
 
-	tails := make(Offsets, len(b.logs))
+	tails := make(Offsets, len(b.topics))
 
-	for topic, file := range b.logs {
-		stat, err := file.Stat()
+	for name, topic := range b.topics {
+		tail, err := topic.tail()
 		if nil != err {
-			log.Warn("Unable to get stats from log file: %s.", file.Name())
+			log.Warn("Unable to get stats from log file for %s.", name)
 			continue
 		}
-		tails[topic] = stat.Size()
+		tails[name] = tail
 	}
 
 	return tails
 
 }
 
+// Epoch returns the latest leader epoch known to this broker for the given
+// partition of a topic.
+func (b *Broker) Epoch(topic string, partition int) int64 {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if r, exists := b.replicas[protocol.PartitionName(topic, partition)]; exists {
+		return r.epoch
+	}
+
+	return 0
+
+}
+
+// LogState returns the state of this broker's log of the given partition, for
+// the register to elect the broker with the most up-to-date log.
+func (b *Broker) LogState(name string) protocol.LogState {
+
+	b.lock.Lock()
+	t, exists := b.topics[name]
+	b.lock.Unlock()
+
+	var state protocol.LogState
+	if !exists {
+		return state
+	}
+
+	if tail, err := t.tail(); nil == err {
+		state.Tail = tail
+		state.Epoch = t.epochAt(tail)
+	}
+
+	return state
+
+}
+
+// JoinElection records that the given round of election of a leader of the
+// given partition has started. Returns false if a later round has already
+// started, in which case the given round must be ignored.
+func (b *Broker) JoinElection(name string, generation int64) bool {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r := b.replica(name)
+	if generation < r.generation {
+		return false
+	}
+
+	r.generation = generation
+	return true
+
+}
+
+// LatestElection returns true iff the given round is the latest round of
+// election of a leader of the given partition seen by this broker.
+func (b *Broker) LatestElection(name string, generation int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.replica(name).generation == generation
+}
+
+// Leader returns the host:port of the leader of the given partition of a
+// topic, or of the register if the leader is not known.
+func (b *Broker) Leader(topic string, partition int) string {
+
+	b.lock.Lock()
+	r, exists := b.replicas[protocol.PartitionName(topic, partition)]
+	b.lock.Unlock()
+
+	if !exists {
+		return b.config.Register()
+	}
+
+	switch hostport := r.leader.HostPort; hostport {
+	case b.Origin(), "":
+		return b.config.Register()
+	default:
+		return hostport
+	}
+
+}
+
 // origin returns the host:port of this broker.
 func (b *Broker) Origin() string {
 	return fmt.Sprintf("%s:%d", b.config.Host(), b.config.Port())
 }
 
-// gets the log file from b.logs, or open it if it does not exist.
-func (b *Broker) getOrOpenLog(topic string) (*Log, error) {
+// StaticRegister returns the host:port of the register embedded in this broker,
+// if it is configured with peers instead of registers.
+func (b *Broker) StaticRegister() string {
+	return protocol.StaticRegister(b.Origin(), b.config.RegisterOffset())
+}
+
+// topic returns the state of the given topic, opening its log if the topic
+// has not been seen before. Caller must not hold the broker lock.
+func (b *Broker) topic(name string) (*Topic, error) {
+
+	b.lock.Lock()
+	t, exists := b.topics[name]
+	b.lock.Unlock()
 
-	file, exists := b.logs[topic]
 	if exists {
-		return file, nil
+		return t, nil
 	}
 
-	file, err := OpenLog(b.config, topic, -1)
+	t, err := openTopic(b.config, name)
 	if nil != err {
 		return nil, err
 	}
 
-	b.logs[topic] = file
-	return file, nil
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// another goroutine may have opened the topic in the meantime
+	if existing, exists := b.topics[name]; exists {
+		t.close()
+		return existing, nil
+	}
+
+	b.topics[name] = t
+	return t, nil
+
+}
+
+// truncate truncates the log for the given topic at the given offset. Caller
+// must hold the broker lock.
+func (b *Broker) truncate(topic string, offset int64) error {
+
+	if t, exists := b.topics[topic]; exists {
+		return t.truncate(b.config, offset)
+	}
+
+	if err := truncateLog(b.config, topic, offset); nil != err {
+		return err
+	}
+
+	if err := truncateEpochs(b.config, topic, offset); nil != err {
+		return err
+	}
+
+	return truncateWatermark(b.config, topic, offset)
 
 }
 
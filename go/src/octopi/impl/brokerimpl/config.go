@@ -1,16 +1,12 @@
 package brokerimpl
 
 import (
+	"octopi/api/protocol"
 	"octopi/util/config"
-	"octopi/util/log"
 	"os"
 	"path/filepath"
 	"strconv"
-)
-
-const (
-	LEADER = iota
-	FOLLOWER
+	"time"
 )
 
 // Configuration options for broker.
@@ -18,9 +14,51 @@ type Config struct {
 	config.Config
 }
 
-// Register returns the "register" option in the configuration.
+// Registers returns the host:ports in the "register" option in the
+// configuration, which lists the registers of the register cluster separated
+// by commas. If the broker is configured with peers instead, the registers
+// are those embedded in the peers.
+func (c *Config) Registers() []string {
+
+	peers := c.Peers()
+	if 0 == len(peers) {
+		return protocol.Registers(c.Get("register"))
+	}
+
+	offset := c.RegisterOffset()
+	registers := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		registers = append(registers, protocol.StaticRegister(peer, offset))
+	}
+	return registers
+
+}
+
+// RegisterOffset returns the offset from the port of each broker of the port
+// of the register embedded in it, if brokers are configured with peers. It
+// must be the same on every broker of the cluster.
+func (c *Config) RegisterOffset() int {
+	n, err := strconv.Atoi(c.Get("register_offset", strconv.Itoa(protocol.STATIC_REGISTER_OFFSET)))
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// Peers returns the host:ports in the "peers" option in the configuration,
+// which lists every broker of a cluster that runs without a separate register,
+// separated by commas.
+func (c *Config) Peers() []string {
+	return protocol.Registers(c.Get("peers", ""))
+}
+
+// Register returns the first register in the "register" option in the
+// configuration.
 func (c *Config) Register() string {
-	return c.Get("register")
+	if registers := c.Registers(); 0 != len(registers) {
+		return registers[0]
+	}
+	return ""
 }
 
 // If log dir is not given, default to a temporary directory.
@@ -56,16 +94,124 @@ func (c *Config) Port() int {
 	return port
 }
 
-// Role returns either "follower" or "leader"
-func (c *Config) Role() int {
-	role := c.Get("role", "follower")
-	switch role {
-	case "follower":
-		return FOLLOWER
-	case "leader":
-		return LEADER
-	default:
-		log.Panic("Invalid role: %s.", role)
+// Default number of partitions per topic.
+const default_partitions = 1
+
+// Partitions returns the number of partitions of each topic.
+func (c *Config) Partitions() int {
+	n, err := strconv.Atoi(c.Get("partitions", strconv.Itoa(default_partitions)))
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// Default lag thresholds for in-sync followers.
+const (
+	default_max_lag_time     = 10000 // ms
+	default_max_lag_messages = 4000
+)
+
+// MaxLagTime returns the maximum amount of time an in-sync follower may go
+// without fully catching up before it is evicted from the in-sync set.
+func (c *Config) MaxLagTime() time.Duration {
+	ms, err := strconv.Atoi(c.Get("max_lag_time", strconv.Itoa(default_max_lag_time)))
+	if nil != err {
+		panic(err)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// MaxLagMessages returns the maximum number of messages an in-sync follower
+// may fall behind before it is evicted from the in-sync set.
+func (c *Config) MaxLagMessages() int64 {
+	n, err := strconv.ParseInt(c.Get("max_lag_messages", strconv.Itoa(default_max_lag_messages)), 10, 64)
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// Default snapshot settings, in bytes.
+const (
+	default_snapshot_threshold = 1 << 20
+	default_snapshot_chunk     = 1 << 20
+)
+
+// SnapshotThreshold returns the number of bytes a follower may be behind before
+// its log is caught up with bulk transfers instead of entry by entry.
+func (c *Config) SnapshotThreshold() int64 {
+	n, err := strconv.ParseInt(c.Get("snapshot_threshold", strconv.Itoa(default_snapshot_threshold)), 10, 64)
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// SnapshotChunk returns the maximum number of bytes sent in each bulk transfer.
+func (c *Config) SnapshotChunk() int64 {
+	n, err := strconv.ParseInt(c.Get("snapshot_chunk", strconv.Itoa(default_snapshot_chunk)), 10, 64)
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// CatchUpRate returns the maximum number of bytes per second sent to followers
+// that are catching up. Unlimited if not positive.
+func (c *Config) CatchUpRate() int64 {
+	n, err := strconv.ParseInt(c.Get("catch_up_rate", "0"), 10, 64)
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// ReplicationRate returns the maximum number of bytes per second sent to
+// in-sync followers. Unlimited if not positive.
+func (c *Config) ReplicationRate() int64 {
+	n, err := strconv.ParseInt(c.Get("replication_rate", "0"), 10, 64)
+	if nil != err {
+		panic(err)
+	}
+	return n
+}
+
+// Default heartbeat settings, in ms.
+const (
+	default_heartbeat_interval = 1000
+	default_session_timeout    = 5000
+	default_lease_timeout      = 4000
+)
+
+// HeartbeatInterval returns the time between heartbeats sent by leaders to the
+// register and to idle followers.
+func (c *Config) HeartbeatInterval() time.Duration {
+	ms, err := strconv.Atoi(c.Get("heartbeat_interval", strconv.Itoa(default_heartbeat_interval)))
+	if nil != err {
+		panic(err)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// LeaseTimeout returns the amount of time for which leadership is held after
+// the register acknowledges a leader request or heartbeat. It must be less
+// than the session timeout of the register, so that a leader steps down before
+// the register elects another one.
+func (c *Config) LeaseTimeout() time.Duration {
+	ms, err := strconv.Atoi(c.Get("lease_timeout", strconv.Itoa(default_lease_timeout)))
+	if nil != err {
+		panic(err)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// SessionTimeout returns the maximum amount of time to wait for a message from
+// the register, a leader or a follower before it is considered dead.
+func (c *Config) SessionTimeout() time.Duration {
+	ms, err := strconv.Atoi(c.Get("session_timeout", strconv.Itoa(default_session_timeout)))
+	if nil != err {
+		panic(err)
 	}
-	return LEADER
+	return time.Duration(ms) * time.Millisecond
 }
@@ -0,0 +1,26 @@
+package brokerimpl
+
+import (
+	"octopi/util/test"
+	"testing"
+)
+
+// TestPeers ensures that brokers configured with peers instead of registers
+// use the registers embedded in their peers.
+func TestPeers(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.StringMatcher)
+	config := newTestConfig()
+	t.AssertEqual(matcher, "localhost:"+testRegisterPort, config.Register())
+
+	config.Options["peers"] = "localhost:12344, localhost:12346"
+	registers := config.Registers()
+	t.AssertEqual(new(test.IntMatcher), 2, len(registers))
+	t.AssertEqual(matcher, "localhost:13344", registers[0])
+	t.AssertEqual(matcher, "localhost:13346", registers[1])
+
+	config.Options["register_offset"] = "-100"
+	t.AssertEqual(matcher, "localhost:12244", config.Register())
+
+}
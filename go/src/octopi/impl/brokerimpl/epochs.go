@@ -0,0 +1,183 @@
+package brokerimpl
+
+import (
+	"encoding/binary"
+	"io"
+	"octopi/api/protocol"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Epochs records the leader epochs in which a topic log was written. Each
+// boundary marks the offset of the first entry written in that epoch, so
+// entries at the same offset and in the same epoch are identical across
+// brokers. Thread-safe.
+type Epochs struct {
+	file       *os.File                 // epochs file
+	boundaries []protocol.EpochBoundary // boundaries in increasing order
+	lock       sync.Mutex               // lock
+}
+
+// Epochs file extension.
+const EPOCHS_EXT = ".epochs"
+
+// OpenEpochs opens the epochs file for the given topic. Logs written before
+// epochs were recorded are treated as if they were written in epoch 0.
+func OpenEpochs(config *Config, topic string) (*Epochs, error) {
+
+	name := filepath.Join(config.LogDir(), topic+EPOCHS_EXT)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, perm)
+	if nil != err {
+		return nil, err
+	}
+
+	epochs := &Epochs{file: file}
+	for {
+		var boundary protocol.EpochBoundary
+		if err := binary.Read(file, binary.LittleEndian, &boundary); nil != err {
+			if io.EOF != err {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		epochs.boundaries = append(epochs.boundaries, boundary)
+	}
+
+	if 0 == len(epochs.boundaries) {
+		stat, err := os.Stat(filepath.Join(config.LogDir(), topic+EXT))
+		if nil == err && stat.Size() > 0 {
+			epochs.Mark(0, 0)
+		}
+	}
+
+	return epochs, nil
+
+}
+
+// truncateEpochs removes all epochs that start at or after the given offset
+// from the epochs file of the given topic.
+func truncateEpochs(config *Config, topic string, offset int64) error {
+
+	epochs, err := OpenEpochs(config, topic)
+	if nil != err {
+		return err
+	}
+
+	defer epochs.Close()
+	return epochs.Truncate(offset)
+
+}
+
+// Mark records that entries from the given offset onwards are written in the
+// given epoch. Does nothing if the epoch is not newer than the latest epoch.
+func (e *Epochs) Mark(epoch int64, offset int64) error {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if n := len(e.boundaries); n > 0 && e.boundaries[n-1].Epoch >= epoch {
+		return nil
+	}
+
+	boundary := protocol.EpochBoundary{epoch, offset}
+	if _, err := e.file.Seek(0, os.SEEK_END); nil != err {
+		return err
+	}
+
+	if err := binary.Write(e.file, binary.LittleEndian, &boundary); nil != err {
+		return err
+	}
+
+	e.boundaries = append(e.boundaries, boundary)
+	return nil
+
+}
+
+// Truncate removes all epochs that start at or after the given offset.
+func (e *Epochs) Truncate(offset int64) error {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	n := 0
+	for n < len(e.boundaries) && e.boundaries[n].Offset < offset {
+		n++
+	}
+
+	e.boundaries = e.boundaries[0:n]
+	if err := e.file.Truncate(0); nil != err {
+		return err
+	}
+
+	if _, err := e.file.Seek(0, os.SEEK_SET); nil != err {
+		return err
+	}
+
+	return binary.Write(e.file, binary.LittleEndian, e.boundaries)
+
+}
+
+// At returns the epoch in which the entry at the given offset was written.
+func (e *Epochs) At(offset int64) int64 {
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var epoch int64
+	for _, boundary := range e.boundaries {
+		if boundary.Offset > offset {
+			break
+		}
+		epoch = boundary.Epoch
+	}
+
+	return epoch
+
+}
+
+// Boundaries returns a copy of the epoch boundaries.
+func (e *Epochs) Boundaries() []protocol.EpochBoundary {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	boundaries := make([]protocol.EpochBoundary, len(e.boundaries))
+	copy(boundaries, e.boundaries)
+	return boundaries
+}
+
+// Close closes the epochs file.
+func (e *Epochs) Close() error {
+	return e.file.Close()
+}
+
+// divergence returns the offset at which the follower's log diverges from the
+// leader's, given the epoch boundaries and tails of both logs. Both logs agree
+// up to the end of the latest epoch they have in common.
+func divergence(leader []protocol.EpochBoundary, leaderTail int64,
+	follower []protocol.EpochBoundary, followerTail int64) int64 {
+
+	for i := len(follower) - 1; i >= 0; i-- {
+		for j := len(leader) - 1; j >= 0; j-- {
+			if leader[j].Epoch != follower[i].Epoch {
+				continue
+			}
+			offset := epochEnd(follower, i, followerTail)
+			if end := epochEnd(leader, j, leaderTail); end < offset {
+				offset = end
+			}
+			return offset
+		}
+	}
+
+	return 0
+
+}
+
+// epochEnd returns the offset at which the i-th epoch ends.
+func epochEnd(boundaries []protocol.EpochBoundary, i int, tail int64) int64 {
+	if i+1 < len(boundaries) {
+		return boundaries[i+1].Offset
+	}
+	return tail
+}
@@ -0,0 +1,69 @@
+package brokerimpl
+
+import (
+	"octopi/api/protocol"
+	"octopi/util/test"
+	"os"
+	"testing"
+)
+
+// TestEpochsPersist ensures that epoch boundaries are persisted and
+// truncated.
+func TestEpochsPersist(tester *testing.T) {
+
+	config := newTestConfig()
+	t := test.New(tester)
+
+	epochs, err := OpenEpochs(config, "epochs")
+	t.AssertNil(err, "OpenEpochs")
+	defer os.Remove(epochs.file.Name())
+
+	t.AssertNil(epochs.Mark(1, 0), "epochs.Mark")
+	t.AssertNil(epochs.Mark(1, 40), "epochs.Mark")
+	t.AssertNil(epochs.Mark(3, 80), "epochs.Mark")
+	t.AssertNil(epochs.Mark(4, 120), "epochs.Mark")
+	epochs.Close()
+
+	epochs, err = OpenEpochs(config, "epochs")
+	t.AssertNil(err, "OpenEpochs")
+	t.AssertEqual(new(test.IntMatcher), 3, len(epochs.Boundaries()))
+	t.AssertEqual(new(test.IntMatcher), 1, int(epochs.At(79)))
+	t.AssertEqual(new(test.IntMatcher), 3, int(epochs.At(80)))
+
+	t.AssertNil(epochs.Truncate(120), "epochs.Truncate")
+	epochs.Close()
+
+	epochs, err = OpenEpochs(config, "epochs")
+	t.AssertNil(err, "OpenEpochs")
+	t.AssertEqual(new(test.IntMatcher), 2, len(epochs.Boundaries()))
+	t.AssertEqual(new(test.IntMatcher), 3, int(epochs.At(200)))
+	epochs.Close()
+
+}
+
+// TestDivergence ensures that followers are truncated at the end of the
+// latest epoch they have in common with the leader.
+func TestDivergence(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+
+	leader := []protocol.EpochBoundary{{1, 0}, {2, 100}, {4, 300}}
+
+	// follower has entries from an epoch that the leader never saw
+	follower := []protocol.EpochBoundary{{1, 0}, {2, 100}, {3, 250}}
+	t.AssertEqual(matcher, 250, int(divergence(leader, 400, follower, 350)))
+
+	// follower is behind in the same epoch
+	follower = []protocol.EpochBoundary{{1, 0}, {2, 100}}
+	t.AssertEqual(matcher, 200, int(divergence(leader, 400, follower, 200)))
+
+	// follower is ahead in the leader's latest epoch
+	follower = []protocol.EpochBoundary{{1, 0}, {2, 100}, {4, 300}}
+	t.AssertEqual(matcher, 400, int(divergence(leader, 400, follower, 500)))
+
+	// nothing in common
+	follower = []protocol.EpochBoundary{{5, 0}}
+	t.AssertEqual(matcher, 0, int(divergence(leader, 400, follower, 500)))
+
+}
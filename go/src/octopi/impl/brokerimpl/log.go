@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -19,6 +20,7 @@ import (
 type Log struct {
 	os.File
 	lastWritten []byte
+	lastOffset  int64 // offset of the last entry written
 }
 
 // LogEntry is an entry in the log file. The file is a sequence of LogEntries.
@@ -33,6 +35,10 @@ const perm os.FileMode = 0644
 // Log file extension.
 const EXT = ".ocp"
 
+// Flag set in the length of entries whose messages have headers. Entries
+// without headers are encoded as before headers existed.
+const HEADERS = 1 << 31
+
 // OpenLog creates/opens a log file with a new file pointer.
 func OpenLog(config *Config, topic string, offset int64) (*Log, error) {
 
@@ -42,17 +48,54 @@ func OpenLog(config *Config, topic string, offset int64) (*Log, error) {
 		return nil, err
 	}
 
+	log := &Log{*file, []byte(""), 0}
 	if offset < 0 { // from tail
-		file.Seek(0, os.SEEK_END)
+		err = log.recover()
 	} else { // from offset
 		_, err = file.Seek(offset, os.SEEK_SET)
 	}
 
 	if nil != err {
+		file.Close()
 		return nil, err
 	}
 
-	return &Log{*file, []byte("")}, nil
+	return log, nil
+
+}
+
+// recover finds the last entry of the log, so that a resend of it is not
+// written again after the log is reopened, and leaves the file pointer at the
+// tail. Only the lengths of entries are read.
+func (log *Log) recover() error {
+
+	stat, err := log.Stat()
+	if nil != err {
+		return err
+	}
+
+	var last int64 = -1
+	for offset := int64(0); offset < stat.Size(); {
+		if _, err := log.Seek(offset, os.SEEK_SET); nil != err {
+			return err
+		}
+		length, err := log.readLength()
+		if nil != err {
+			break
+		}
+		last, offset = offset, offset+4+int64(size(length))
+	}
+
+	if last >= 0 {
+		entry := make([]byte, 36)
+		if _, err := log.ReadAt(entry, last+4); nil == err {
+			log.lastWritten = entry[4:]
+			log.lastOffset = last
+		}
+	}
+
+	_, err = log.Seek(0, os.SEEK_END)
+	return err
 
 }
 
@@ -108,6 +151,7 @@ func (log *Log) WriteNext(entry *LogEntry) error {
 	}
 
 	log.lastWritten = entry.RequestId
+	log.lastOffset = checkpoint
 	debug.Info("wrote request %v.", entry.RequestId)
 
 	return nil
@@ -118,12 +162,100 @@ func (log *Log) WriteNext(entry *LogEntry) error {
 func (log *Log) Append(producer string,
 	message *protocol.Message) (*LogEntry, error) {
 
-	requeststr := fmt.Sprintf("%s:%d", producer, message.ID)
+	entry := &LogEntry{*message, requestId(producer, message)}
+	return entry, log.WriteNext(entry)
+
+}
+
+// IsLast returns true iff the given message from the given producer is the
+// last entry written to the log, in which case appending it does nothing.
+func (log *Log) IsLast(producer string, message *protocol.Message) bool {
+	return bytes.Equal(requestId(producer, message), log.lastWritten)
+}
+
+// requestId returns the ID of the request in which the given producer sent
+// the given message.
+func requestId(producer string, message *protocol.Message) []byte {
 	hasher := sha256.New()
-	hasher.Write([]byte(requeststr))
+	hasher.Write([]byte(fmt.Sprintf("%s:%d", producer, message.ID)))
+	return hasher.Sum(nil)
+}
 
-	entry := &LogEntry{*message, hasher.Sum(nil)}
-	return entry, log.WriteNext(entry)
+// ReadChunk reads the raw encoding of as many whole entries as fit in max
+// bytes, starting at the file pointer. At least one entry is read, even if it
+// is larger than max. Returns io.EOF if there is no whole entry to read.
+func (log *Log) ReadChunk(max int64) ([]byte, error) {
+
+	start, err := log.Seek(0, os.SEEK_CUR)
+	if nil != err {
+		return nil, err
+	}
+
+	stat, err := log.Stat()
+	if nil != err {
+		return nil, err
+	}
+
+	// find the end of the last whole entry that fits
+	end := start
+	for {
+		length, err := log.readLength()
+		if nil != err {
+			break
+		}
+		next := end + 4 + int64(size(length))
+		if next > stat.Size() || (next-start > max && end > start) {
+			break
+		}
+		end = next
+		if _, err := log.Seek(end, os.SEEK_SET); nil != err {
+			return nil, err
+		}
+	}
+
+	if end == start {
+		log.Seek(start, os.SEEK_SET)
+		return nil, io.EOF
+	}
+
+	chunk := make([]byte, end-start)
+	if _, err := log.ReadAt(chunk, start); nil != err {
+		log.Seek(start, os.SEEK_SET)
+		return nil, err
+	}
+
+	_, err = log.Seek(end, os.SEEK_SET)
+	return chunk, err
+
+}
+
+// WriteChunk writes the raw encoding of whole entries, as read by ReadChunk,
+// at the end of the broker log. The last entry of the chunk becomes the last
+// entry written.
+func (log *Log) WriteChunk(chunk []byte) error {
+
+	// in case of error, revert
+	checkpoint, _ := log.Seek(0, os.SEEK_CUR)
+
+	if _, err := log.Write(chunk); nil != err {
+		log.Truncate(checkpoint)
+		log.Seek(checkpoint, os.SEEK_SET)
+		return err
+	}
+
+	// find the last entry of the chunk
+	last := 0
+	for next := 0; next+40 <= len(chunk); {
+		last = next
+		next += 4 + int(size(binary.LittleEndian.Uint32(chunk[next:])))
+	}
+
+	if last+40 <= len(chunk) {
+		log.lastWritten = append([]byte(nil), chunk[last+8:last+40]...)
+		log.lastOffset = checkpoint + int64(last)
+	}
+
+	return nil
 
 }
 
@@ -143,6 +275,9 @@ func (log *Log) IsEOF() bool {
 // readEntry reads the next n bytes and decodes them into a log entry.
 func (log *Log) readEntry(n uint32) (*LogEntry, error) {
 
+	flags := n & HEADERS
+	n = size(n)
+
 	debug.Info("Making slice of size n=%v", n)
 	buf := make([]byte, n)
 	total := uint32(0)
@@ -159,7 +294,7 @@ func (log *Log) readEntry(n uint32) (*LogEntry, error) {
 	}
 
 	var entry LogEntry
-	return &entry, entry.decode(buf)
+	return &entry, entry.decode(buf, 0 != flags)
 
 }
 
@@ -173,7 +308,7 @@ func (log *Log) writeEntry(entry *LogEntry) (int, error) {
 	return log.Write(buffer)
 }
 
-// readLength reads the length of the next entry.
+// readLength reads the length of the next entry, along with its flags.
 func (log *Log) readLength() (uint32, error) {
 
 	var length uint32
@@ -185,14 +320,24 @@ func (log *Log) readLength() (uint32, error) {
 
 }
 
-// writeLength writes the length of the entry to the broker log.
+// writeLength writes the length of the entry, along with its flags, to the
+// broker log.
 func (log *Log) writeLength(entry *LogEntry) error {
 	length := entry.length()
+	if len(entry.Headers) > 0 {
+		length |= HEADERS
+	}
 	return binary.Write(log, binary.LittleEndian, length)
 }
 
-// decode decodes the given byte buffer into a log entry.
-func (entry *LogEntry) decode(buffer []byte) error {
+// size returns the length of an entry without its flags.
+func size(length uint32) uint32 {
+	return length &^ HEADERS
+}
+
+// decode decodes the given byte buffer into a log entry, which has headers iff
+// the given flag is set.
+func (entry *LogEntry) decode(buffer []byte, headers bool) error {
 
 	reader := bytes.NewReader(buffer)
 
@@ -205,8 +350,24 @@ func (entry *LogEntry) decode(buffer []byte) error {
 	// read request ID
 	entry.RequestId = buffer[4:36]
 
+	// read headers
+	start := uint32(36)
+	if headers {
+		if len(buffer) < 40 {
+			return errors.New("Truncated headers.")
+		}
+		n := binary.LittleEndian.Uint32(buffer[36:40])
+		if uint32(len(buffer)) < 40+n {
+			return errors.New("Truncated headers.")
+		}
+		if err := json.Unmarshal(buffer[40:40+n], &entry.Headers); nil != err {
+			return err
+		}
+		start = 40 + n
+	}
+
 	// read payload
-	entry.Payload = buffer[36:]
+	entry.Payload = buffer[start:]
 	return nil
 
 }
@@ -230,6 +391,19 @@ func (entry *LogEntry) encode() ([]byte, error) {
 		return nil, err
 	}
 
+	// write headers
+	if len(entry.Headers) > 0 {
+		headers, err := json.Marshal(entry.Headers)
+		if nil != err {
+			return nil, err
+		}
+		err = binary.Write(writer, binary.LittleEndian, uint32(len(headers)))
+		if nil != err {
+			return nil, err
+		}
+		writer.Write(headers)
+	}
+
 	// write payload
 	_, err = writer.Write(entry.Payload)
 	return writer.Bytes()[0:n], err
@@ -247,5 +421,10 @@ func (entry *LogEntry) validate() error {
 
 // length returns the length of the entry's encoding in the log file.
 func (entry *LogEntry) length() uint32 {
-	return uint32(36 + len(entry.Payload))
+	n := 36 + len(entry.Payload)
+	if len(entry.Headers) > 0 {
+		headers, _ := json.Marshal(entry.Headers)
+		n += 4 + len(headers)
+	}
+	return uint32(n)
 }
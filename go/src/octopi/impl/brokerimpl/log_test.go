@@ -23,7 +23,7 @@ func TestReadWrite(tester *testing.T) {
 	var i byte
 	for i = 1; i <= 10; i++ {
 		payload := []byte{i}
-		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload)}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
 		_, err := log.Append("x", message)
 		t.AssertNil(err, "log.Append")
 	}
@@ -58,7 +58,7 @@ func TestDuplicateDetection(tester *testing.T) {
 	var i byte
 	for i = 1; i <= 10; i++ {
 		payload := []byte{i}
-		message := &protocol.Message{1, payload, crc32.ChecksumIEEE(payload)}
+		message := &protocol.Message{1, payload, crc32.ChecksumIEEE(payload), nil}
 		_, err := log.Append("x", message)
 		t.AssertNil(err, "log.Append")
 	}
@@ -94,7 +94,7 @@ func TestOpenFromEnd(tester *testing.T) {
 	var i byte
 	for i = 1; i <= 10; i++ {
 		payload := []byte{i}
-		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload)}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
 		_, err := log.Append("x", message)
 		t.AssertNil(err, "log.Append")
 	}
@@ -128,7 +128,7 @@ func TestOpenFromOffset(tester *testing.T) {
 	var i byte
 	for i = 1; i <= 10; i++ {
 		payload := []byte{i}
-		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload)}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
 		_, err := log.Append("x", message)
 		t.AssertNil(err, "log.Append")
 	}
@@ -163,7 +163,7 @@ func TestTruncateLog(tester *testing.T) {
 	var i byte
 	for i = 1; i <= 10; i++ {
 		payload := []byte{i}
-		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload)}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
 		_, err := log.Append("x", message)
 		t.AssertNil(err, "log.Append")
 	}
@@ -198,3 +198,146 @@ func TestOpenError(tester *testing.T) {
 	t.AssertNotNil(err, "OpenLog")
 
 }
+
+// TestChunks ensures that chunks of whole entries can be copied from one log
+// file to another.
+func TestChunks(tester *testing.T) {
+
+	config := newTestConfig()
+	t := test.New(tester)
+
+	src, err := OpenLog(config, "temp", 0)
+	t.AssertNil(err, "OpenLog")
+	defer os.Remove(src.Name())
+
+	var i byte
+	for i = 1; i <= 10; i++ {
+		payload := []byte{i}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
+		_, err := src.Append("x", message)
+		t.AssertNil(err, "src.Append")
+	}
+
+	dst, err := OpenLog(config, "chunks", 0)
+	t.AssertNil(err, "OpenLog")
+	defer os.Remove(dst.Name())
+
+	src.Seek(0, os.SEEK_SET)
+	for {
+		// each entry is 41 bytes, so this reads three at a time
+		chunk, err := src.ReadChunk(125)
+		if io.EOF == err {
+			break
+		}
+		t.AssertNil(err, "src.ReadChunk")
+		t.AssertEqual(new(test.IntMatcher), 0, len(chunk)%41)
+		t.AssertNil(dst.WriteChunk(chunk), "dst.WriteChunk")
+	}
+
+	src.Close()
+	dst.Seek(0, os.SEEK_SET)
+
+	for i = 1; i <= 10; i++ {
+		entry, err := dst.ReadNext()
+		t.AssertNil(err, "dst.ReadNext()")
+		t.AssertEqual(new(test.IntMatcher), int(i), int(entry.Payload[0]))
+	}
+
+	_, err = dst.ReadNext()
+	t.AssertTrue(io.EOF == err, "dst.ReadNext()")
+	dst.Close()
+
+}
+
+// TestHeaders ensures that the headers of messages are stored in the log, and
+// copied along with chunks, while messages without headers are encoded as
+// before.
+func TestHeaders(tester *testing.T) {
+
+	config := newTestConfig()
+	t := test.New(tester)
+
+	src, err := OpenLog(config, "temp", 0)
+	t.AssertNil(err, "OpenLog")
+	defer os.Remove(src.Name())
+
+	payload := []byte{1}
+	headers := map[string]string{"source-offset": "42"}
+	_, err = src.Append("x", &protocol.Message{1, payload, crc32.ChecksumIEEE(payload), headers})
+	t.AssertNil(err, "src.Append")
+	_, err = src.Append("x", &protocol.Message{2, payload, crc32.ChecksumIEEE(payload), nil})
+	t.AssertNil(err, "src.Append")
+
+	src.Seek(0, os.SEEK_SET)
+	chunk, err := src.ReadChunk(1024)
+	t.AssertNil(err, "src.ReadChunk")
+	src.Close()
+
+	dst, err := OpenLog(config, "chunks", 0)
+	t.AssertNil(err, "OpenLog")
+	defer os.Remove(dst.Name())
+	t.AssertNil(dst.WriteChunk(chunk), "dst.WriteChunk")
+	dst.Seek(0, os.SEEK_SET)
+
+	entry, err := dst.ReadNext()
+	t.AssertNil(err, "dst.ReadNext()")
+	t.AssertEqual(new(test.StringMatcher), "42", entry.Headers["source-offset"])
+	t.AssertEqual(new(test.IntMatcher), 1, int(entry.Payload[0]))
+
+	entry, err = dst.ReadNext()
+	t.AssertNil(err, "dst.ReadNext()")
+	t.AssertTrue(nil == entry.Headers, "entry.Headers")
+	// 41 bytes, and 4 for the length of the headers and 22 for the headers
+	t.AssertEqual(new(test.IntMatcher), 67, int(entry.ID))
+	dst.Close()
+
+}
+
+// TestResendAfterReopen ensures that a resend of the last entry of a log is
+// dropped after the log is reopened, or after the entry was copied in a chunk.
+func TestResendAfterReopen(tester *testing.T) {
+
+	config := newTestConfig()
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+
+	log, err := OpenLog(config, "temp", 0)
+	t.AssertNil(err, "OpenLog")
+	defer os.Remove(log.Name())
+
+	var i byte
+	for i = 1; i <= 3; i++ {
+		payload := []byte{i}
+		_, err := log.Append("x", &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil})
+		t.AssertNil(err, "log.Append")
+	}
+
+	log.Seek(0, os.SEEK_SET)
+	chunk, err := log.ReadChunk(1024)
+	t.AssertNil(err, "log.ReadChunk")
+	log.Close()
+
+	payload := []byte{3}
+	resend := &protocol.Message{3, payload, crc32.ChecksumIEEE(payload), nil}
+
+	log, err = OpenLog(config, "temp", -1)
+	t.AssertNil(err, "OpenLog")
+	_, err = log.Append("x", resend)
+	t.AssertNil(err, "log.Append")
+	t.AssertEqual(matcher, 82, int(log.lastOffset))
+	tail, _ := log.Seek(0, os.SEEK_CUR)
+	t.AssertEqual(matcher, 123, int(tail))
+	log.Close()
+
+	copied, err := OpenLog(config, "chunks", 0)
+	t.AssertNil(err, "OpenLog")
+	defer os.Remove(copied.Name())
+	t.AssertNil(copied.WriteChunk(chunk), "copied.WriteChunk")
+	_, err = copied.Append("x", resend)
+	t.AssertNil(err, "copied.Append")
+	t.AssertEqual(matcher, 82, int(copied.lastOffset))
+	tail, _ = copied.Seek(0, os.SEEK_CUR)
+	t.AssertEqual(matcher, 123, int(tail))
+	copied.Close()
+
+}
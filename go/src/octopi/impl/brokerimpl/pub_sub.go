@@ -3,38 +3,55 @@ package brokerimpl
 // This file contains the publish and subscribe functions.
 import (
 	"code.google.com/p/go.net/websocket"
-	"errors"
+	"fmt"
 	"octopi/api/protocol"
 	"octopi/util/log"
+	"strings"
 )
 
-// Subscribe creates a new subscription for the given consumer connection.
-// Consumers are allowed to register for non-existent topics, but will not
-// receive any messages until a producer publishes a message under that topic.
+// Subscribe creates a new subscription to a partition of a topic for the given
+// consumer connection. Consumers are allowed to register for non-existent
+// topics, but will not receive any messages until a producer publishes a
+// message under that topic. Unless uncommitted is set, consumers only receive
+// messages below the high watermark. Followers only serve committed messages,
+// since they may not have seen uncommitted ones.
 func (b *Broker) Subscribe(
 	conn *websocket.Conn,
 	topic string,
-	offset int64) (*Subscription, error) {
+	partition int,
+	offset int64,
+	uncommitted bool) (*Subscription, error) {
+
+	if err := b.checkPartition(topic, partition); nil != err {
+		return nil, err
+	}
 
 	// create new subscription
-	subscription, err := NewSubscription(b, conn, topic, offset)
+	subscription, err := NewSubscription(b, conn, protocol.PartitionName(topic, partition), offset)
 	if nil != err {
 		return nil, err
 	}
 
-	var subscriptions SubscriptionSet
+	name := protocol.PartitionName(topic, partition)
 
 	b.lock.Lock()
-	defer b.lock.Unlock()
+	r, exists := b.replicas[name]
+	leading := exists && LEADER == r.role
+	b.lock.Unlock()
 
-	// save subscription
-	subscriptions, exists := b.subscriptions[topic]
-	if !exists {
-		subscriptions = make(map[*Subscription]bool)
-		b.subscriptions[topic] = subscriptions
+	if uncommitted && !leading {
+		log.Info("Serving only committed messages of %s as a follower.", name)
+		uncommitted = false
 	}
-	subscriptions[subscription] = true
 
+	subscription.uncommitted = uncommitted
+
+	t := subscription.topic
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// save subscription
+	t.subscriptions[subscription] = true
 	return subscription, nil
 
 }
@@ -42,109 +59,209 @@ func (b *Broker) Subscribe(
 // Unsubscribe removes the given subscription from the broker.
 func (b *Broker) Unsubscribe(topic string, subscription *Subscription) {
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
+	t := subscription.topic
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	subscriptions, exists := b.subscriptions[topic]
-	if !exists {
+	if _, exists := t.subscriptions[subscription]; !exists {
 		return
 	}
 
 	subscription.quit <- nil
-	delete(subscriptions, subscription)
-
-}
+	delete(t.subscriptions, subscription)
 
-// wait checks if the subscription is really at the end of the log. It returns
-// iff there is more to be read.
-func (b *Broker) wait(s *Subscription) {
+	// wake up the subscription so that it sees the quit message
+	t.cond.Broadcast()
 
-	b.lock.Lock()
-	defer b.lock.Unlock()
+}
 
-	for s.log.IsEOF() {
-		b.cond.Wait()
-		return
+// Publish publishes the given message to all subscribers of a partition of
+// the topic. It returns after all in-sync followers of the partition have
+// acknowledged the message, and the high watermark has been raised past it.
+// The message is appended under the partition's lock, so unrelated topics and
+// partitions may be published to in parallel, and acknowledgements only wake
+// publishers of their own partition. Returns the offset at which the
+// message was written, or NOT_LEADER if this broker does not lead the
+// partition, its lease has expired, or it is handing off leadership of it.
+func (b *Broker) Publish(topic string, partition int, producer string, msg *protocol.Message) (int64, error) {
+
+	offsets, err := b.PublishBatch(topic, partition, producer, []protocol.Message{*msg})
+	if nil != err {
+		return 0, err
 	}
 
+	return offsets[0], nil
+
 }
 
-// Publish publishes the given message to all subscribers.
-func (b *Broker) Publish(topic, producer string, msg *protocol.Message) error {
+// PublishBatch publishes the given messages to a partition of the topic in
+// order, like Publish, but waits for followers to acknowledge them only once.
+// Returns the offset at which each message was written.
+func (b *Broker) PublishBatch(topic string, partition int, producer string, msgs []protocol.Message) ([]int64, error) {
+
+	if err := b.checkPartition(topic, partition); nil != err {
+		return nil, err
+	}
+
+	name := protocol.PartitionName(topic, partition)
 
-	// TODO: topic-specific locks
 	b.lock.Lock()
-	defer b.lock.Unlock()
+	r, exists := b.replicas[name]
+	leading := exists && r.leased() && !r.transferring
+	var epoch int64
+	if leading {
+		epoch = r.epoch
+		r.publishing++
+	}
+	b.lock.Unlock()
 
-	if b.role != LEADER {
-		return errors.New("I am not the leader.")
+	if !leading {
+		return nil, NOT_LEADER
 	}
 
-	file, err := b.getOrOpenLog(topic)
+	defer b.published(r)
+
+	t, err := b.topic(name)
 	if nil != err {
-		return err
+		return nil, err
 	}
 
-	entry, err := file.Append(producer, msg)
+	offsets, tail, err := t.publishBatch(producer, msgs, epoch)
 	if nil != err {
-		return err
+		return nil, err
 	}
 
-	b.replicate(topic, entry)
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-	b.cond.Broadcast()
-	return nil
+	for follower, _ := range r.followers {
+		follower.pending += int64(len(msgs))
+	}
+
+	r.cond.Broadcast()
+	b.replicate(r, tail)
+
+	// leadership may have been lost while waiting for followers, and the new
+	// leader may truncate the messages
+	if LEADER != r.role || epoch != r.epoch || !r.leased() {
+		return nil, NOT_LEADER
+	}
+
+	return offsets, t.commit(tail)
 
 }
 
-// replicate  replicates the given log entry across all followers.
-func (b *Broker) replicate(topic string, entry *LogEntry) error {
+// published marks a publish to the given partition as no longer in progress.
+func (b *Broker) published(r *Replica) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	r.publishing--
+	r.cond.Broadcast()
+}
 
-	// send message to all followers
-	for follower, _ := range b.followers {
-		sync := &protocol.Sync{topic, entry.Message, entry.RequestId}
-		log.Info("Sending %v to %v", entry.Message.ID, follower.hostport)
-		if err := websocket.JSON.Send(follower.conn, sync); nil != err {
-			// lost
-			b.removeFollower(follower)
-		}
+// checkPartition returns an error if the given partition does not exist, or
+// if the name of the topic contains the partition separator, so that it could
+// be mistaken for a partition of another topic.
+func (b *Broker) checkPartition(topic string, partition int) error {
+	if strings.Contains(topic, protocol.PARTITION_SEP) {
+		return fmt.Errorf("Invalid topic %s: must not contain %s.", topic, protocol.PARTITION_SEP)
+	}
+	if partition < 0 || partition >= b.config.Partitions() {
+		return fmt.Errorf("Invalid partition %d.", partition)
+	}
+	return nil
+}
+
+// replicate waits until all in-sync followers have acknowledged the given
+// offset of the partition log. Followers that fall behind are evicted from the
+// in-sync set, so this does not wait on them forever. Caller must hold the
+// broker lock.
+func (b *Broker) replicate(r *Replica, offset int64) {
+	for !b.replicated(r, offset) {
+		r.cond.Wait()
 	}
+}
 
-	// wait for ACK
-	for follower, _ := range b.followers {
-		var ack protocol.SyncACK
-		if err := websocket.JSON.Receive(follower.conn, &ack); nil != err {
-			// lost
-			b.removeFollower(follower)
+// replicated returns true iff all in-sync followers have acknowledged the
+// given offset of the partition log.
+func (b *Broker) replicated(r *Replica, offset int64) bool {
+	for follower, _ := range r.followers {
+		if follower.insync && follower.tails[r.name] < offset {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// admitFollower adds the follower to the in-sync set and notifies the
+// register. Caller must hold the broker lock.
+func (b *Broker) admitFollower(f *Follower) {
+
+	f.insync = true
+	f.pending = 0
+
+	// create struct to communicate with register
+	var addFollow protocol.InsyncChange
+	addFollow.Type = protocol.ADD
+	addFollow.HostPort = f.hostport
+	b.notifyRegister(f.replica, &addFollow)
+
+	log.Info("Follower %v has fully caught up on %s.", f.hostport, f.replica.name)
 
 }
 
-// removeFollower disconnects follower from followers set.
-func (b *Broker) removeFollower(follower *Follower) {
+// evictFollower removes the follower from the in-sync set and notifies the
+// register. The follower remains in the follower set, and will be re-admitted
+// once it catches up. Caller must hold the broker lock.
+func (b *Broker) evictFollower(f *Follower) {
 
-	_, exists := b.followers[follower]
-	if !exists {
+	if !f.insync {
 		return
 	}
 
-	delete(b.followers, follower)
+	f.insync = false
 
 	// create struct to communicate with register
 	var removeFollow protocol.InsyncChange
 	removeFollow.Type = protocol.REMOVE
-	removeFollow.HostPort = follower.hostport
+	removeFollow.HostPort = f.hostport
+	b.notifyRegister(f.replica, &removeFollow)
+
+	// wake up publishers waiting for this follower
+	f.replica.cond.Broadcast()
+
+	log.Info("Evicted follower %v from in-sync set of %s.", f.hostport, f.replica.name)
+
+}
+
+// removeFollower disconnects follower from the followers set of its
+// partition. Caller must hold the broker lock.
+func (b *Broker) removeFollower(follower *Follower) {
 
-	// add in-sync follower
-	// check if disconnect from register. if so, exit.
-	websocket.JSON.Send(b.regConn, removeFollow)
-	// checkError(err) // FIXME: exiting is not the correct thing to do
+	_, exists := follower.replica.followers[follower]
+	if !exists {
+		return
+	}
 
-	follower.quit <- nil
+	b.evictFollower(follower)
+	delete(follower.replica.followers, follower)
 
 	log.Info("Removed follower %v from follower set.", follower.hostport)
 
 }
+
+// notifyRegister stamps the given in-sync change with the leader epoch of the
+// partition and sends it to the register over the partition's leader
+// connection. Returns an error if the change could not be sent. Caller must
+// hold the broker lock.
+func (b *Broker) notifyRegister(r *Replica, change *protocol.InsyncChange) error {
+	change.Epoch = r.epoch
+	if nil == r.regConn {
+		return NO_REGISTER
+	}
+	if err := websocket.JSON.Send(r.regConn, change); nil != err {
+		log.Warn("Unable to update register: %s.", err.Error())
+		return err
+	}
+	return nil
+}
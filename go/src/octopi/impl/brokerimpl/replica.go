@@ -0,0 +1,90 @@
+package brokerimpl
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"sync"
+	"time"
+)
+
+// Roles of a broker with respect to a partition.
+const (
+	LEADER = iota
+	FOLLOWER
+)
+
+// Replicas hold the replication state of a single partition on this broker.
+// Every partition has its own leader, so a broker may lead some partitions and
+// follow others.
+type Replica struct {
+	name         string           // name of partition
+	role         int              // leader or follower of this partition
+	epoch        int64            // latest leader epoch seen for this partition
+	followers    FollowerSet      // set of followers, if leader
+	leader       *protocol.Socket // connection to the leader, if follower
+	regConn      *websocket.Conn  // connection to the register, if leader
+	publishing   int              // number of publishes in progress, if leader
+	transferring bool             // true iff leadership is being handed off
+	lease        time.Time        // time at which leadership expires, if leader
+	beats        []time.Time      // times of heartbeats not yet acknowledged
+	generation   int64            // latest round of leader election seen
+	cond         *sync.Cond       // signalled on replication progress; uses the broker lock
+}
+
+// leased returns true iff this broker leads the partition, and its lease from
+// the register has not expired. Caller must hold the broker lock.
+func (r *Replica) leased() bool {
+	return LEADER == r.role && time.Now().Before(r.lease)
+}
+
+// replica returns the replication state of the given partition, creating it
+// if the partition has not been seen before. Caller must hold the broker lock.
+func (b *Broker) replica(name string) *Replica {
+
+	if r, exists := b.replicas[name]; exists {
+		return r
+	}
+
+	r := &Replica{
+		name:      name,
+		role:      FOLLOWER,
+		followers: make(FollowerSet),
+		leader: &protocol.Socket{
+			HostPort:  b.config.Register(),
+			Path:      protocol.FOLLOW,
+			Origin:    b.Origin(),
+			Registers: b.config.Registers(),
+			Timeout:   b.config.SessionTimeout(),
+		},
+	}
+
+	// only publishers and followers of this partition wait on its progress
+	r.cond = sync.NewCond(&b.lock)
+	b.replicas[name] = r
+	return r
+
+}
+
+// stepDown gives up leadership of the given partition, and disconnects all of
+// its followers. Caller must hold the broker lock.
+func (b *Broker) stepDown(r *Replica) {
+
+	for follower, _ := range r.followers {
+		delete(r.followers, follower)
+		follower.quit <- nil
+		follower.conn.Close()
+	}
+
+	if nil != r.regConn {
+		r.regConn.Close()
+		r.regConn = nil
+	}
+
+	r.beats = nil
+	r.role = FOLLOWER
+	r.cond.Broadcast()
+
+	log.Info("Stepped down as leader of %s.", r.name)
+
+}
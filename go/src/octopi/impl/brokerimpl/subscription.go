@@ -4,15 +4,18 @@ import (
 	"code.google.com/p/go.net/websocket"
 	"io"
 	"octopi/util/log"
+	"os"
 )
 
 // Subscriptions are used to store consumer connections; each subscription has
-// a go channel that relays messages to the consumer.
+// a go channel that relays messages to the consumer. Subscriptions only read up
+// to the high watermark of the log, unless they opt in to uncommitted reads.
 type Subscription struct {
-	broker *Broker
-	conn   *websocket.Conn // consumer websocket connection
-	log    *Log            // broker log
-	quit   chan interface{}
+	topic       *Topic          // subscribed topic
+	conn        *websocket.Conn // consumer websocket connection
+	log         *Log            // broker log
+	uncommitted bool            // true iff reading past the high watermark
+	quit        chan interface{}
 }
 
 // NewSubscription creates a new subscription for the given topic. Messages are
@@ -23,16 +26,21 @@ func NewSubscription(
 	topic string,
 	offset int64) (*Subscription, error) {
 
+	t, err := broker.topic(topic)
+	if nil != err {
+		return nil, err
+	}
+
 	log, err := OpenLog(broker.config, topic, offset)
 	if nil != err {
 		return nil, err
 	}
 
 	return &Subscription{
-		broker: broker,
-		conn:   conn,
-		log:    log,
-		quit:   make(chan interface{}, 1),
+		topic: t,
+		conn:  conn,
+		log:   log,
+		quit:  make(chan interface{}, 1),
 	}, nil
 
 }
@@ -62,19 +70,26 @@ func (s *Subscription) Serve() error {
 }
 
 // next reads the next message from the associated log file. When it reaches
-// the end of the file, it waits (using a conditional variable) for more
-// messages from the broker. As a consequence of this design, a waiting
-// subscription cannot be closed until a new message is published, waking it
-// up. Returns nil or associated error.
+// the end of the file or the high watermark, it waits (using the topic's
+// conditional variable) for more messages from the broker. As a consequence
+// of this design, a waiting subscription cannot be closed until a new message
+// is published or the topic is signalled, waking it up. Returns nil or
+// associated error.
 func (s *Subscription) next() error {
 
+	if !s.topic.readable(s) {
+		log.Debug("Reached high watermark.")
+		s.topic.wait(s)
+		return nil
+	}
+
 	entry, err := s.log.ReadNext()
 
 	switch err {
 	case nil:
 	case io.EOF: // wait for more
 		log.Debug("Reached end of log.")
-		s.broker.wait(s)
+		s.topic.wait(s)
 		return nil
 	default: // abort
 		return err
@@ -83,3 +98,9 @@ func (s *Subscription) next() error {
 	return websocket.JSON.Send(s.conn, &entry.Message)
 
 }
+
+// offset returns the offset of the next entry to be read.
+func (s *Subscription) offset() int64 {
+	offset, _ := s.log.Seek(0, os.SEEK_CUR)
+	return offset
+}
@@ -8,6 +8,7 @@ import (
 	"octopi/api/protocol"
 	"octopi/util/test"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -51,7 +52,7 @@ func TestQuit(tester *testing.T) {
 	go func() {
 		time.Sleep(200 * time.Millisecond)
 		subscription.quit <- nil
-		broker.cond.Broadcast()
+		subscription.topic.cond.Broadcast()
 	}()
 
 	err = subscription.Serve() // should return after 200ms
@@ -71,6 +72,9 @@ func TestServe(tester *testing.T) {
 	client, listener := newTestClient(t, sum(t, &result))
 	defer register.Close()
 
+	// logs without a watermark are fully committed
+	os.Remove(filepath.Join(config.LogDir(), "temp"+WATERMARK_EXT))
+
 	log, err := OpenLog(config, "temp", 0)
 	t.AssertNil(err, "OpenLog")
 
@@ -80,7 +84,7 @@ func TestServe(tester *testing.T) {
 	var i byte
 	for i = 1; i <= 10; i++ {
 		payload := []byte{i}
-		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload)}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
 		_, err := log.Append("x", message)
 		t.AssertNil(err, "log.Append")
 	}
@@ -96,7 +100,7 @@ func TestServe(tester *testing.T) {
 		client.Close()
 		listener.Close()
 		subscription.quit <- nil
-		broker.cond.Broadcast()
+		subscription.topic.cond.Broadcast()
 	}()
 
 	err = subscription.Serve()
@@ -138,6 +142,23 @@ func sum(t *test.Test, x *byte) func(*websocket.Conn) {
 	}
 }
 
+// total sums up all values received from the connection, and sends the sum
+// once the connection is closed.
+func total(sums chan<- byte) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		defer conn.Close()
+		var x byte
+		for {
+			message := new(protocol.Message)
+			if err := websocket.JSON.Receive(conn, message); nil != err {
+				sums <- x
+				return
+			}
+			x += message.Payload[0]
+		}
+	}
+}
+
 // TestWait ensures that subscribers can wait on producers.
 func TestWait(tester *testing.T) {
 
@@ -153,6 +174,7 @@ func TestWait(tester *testing.T) {
 
 	broker, err := New(&config.Config)
 	t.AssertNil(err, "New")
+	t.AssertNil(broker.BecomeLeader("temp"), "BecomeLeader")
 
 	subscription, err := NewSubscription(broker, client, "temp", 0)
 	t.AssertNil(err, "NewSubscription")
@@ -162,13 +184,13 @@ func TestWait(tester *testing.T) {
 		var i byte
 		for i = 1; i <= 10; i++ {
 			payload := []byte{i}
-			message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload)}
-			err = broker.Publish("temp", "x", message)
+			message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
+			_, err = broker.Publish("temp", 0, "x", message)
 			t.AssertNil(err, "broker.Publish")
 		}
 		time.Sleep(500 * time.Millisecond)
 		subscription.quit <- nil
-		broker.cond.Broadcast()
+		subscription.topic.cond.Broadcast()
 	}()
 
 	err = subscription.Serve()
@@ -177,5 +199,88 @@ func TestWait(tester *testing.T) {
 
 	log, err := OpenLog(config, "temp", 0)
 	os.Remove(log.Name())
+	os.Remove(filepath.Join(config.LogDir(), "temp"+WATERMARK_EXT))
+
+}
+
+// TestReadCommitted ensures that subscribers stop at the high watermark, unless
+// they read uncommitted messages.
+func TestReadCommitted(tester *testing.T) {
+
+	config := newTestConfig()
+	t := test.New(tester)
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	topic, err := broker.topic("committed")
+	t.AssertNil(err, "broker.topic")
+	defer os.Remove(filepath.Join(config.LogDir(), "committed"+EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "committed"+EPOCHS_EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "committed"+WATERMARK_EXT))
+
+	var i byte
+	for i = 1; i <= 10; i++ {
+		payload := []byte{i}
+		message := &protocol.Message{int64(i), payload, crc32.ChecksumIEEE(payload), nil}
+		tail, err := topic.publish("x", message, 1)
+		t.AssertNil(err, "topic.publish")
+		if 5 == i {
+			t.AssertNil(topic.commit(tail), "topic.commit")
+		}
+	}
+
+	for _, uncommitted := range []bool{false, true} {
+
+		sums := make(chan byte, 1)
+		client, listener := newTestClient(t, total(sums))
+
+		subscription, err := NewSubscription(broker, client, "committed", 0)
+		t.AssertNil(err, "NewSubscription")
+		subscription.uncommitted = uncommitted
+
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			client.Close()
+			listener.Close()
+			subscription.quit <- nil
+			subscription.topic.cond.Broadcast()
+		}()
+
+		err = subscription.Serve()
+		t.AssertNil(err, "subscription.Serve()")
+		result := <-sums
+		if uncommitted {
+			t.AssertEqual(new(test.IntMatcher), 55, int(result))
+		} else {
+			t.AssertEqual(new(test.IntMatcher), 15, int(result))
+		}
+
+	}
+
+}
+
+// TestFollowerReadsCommitted ensures that followers ignore requests to read
+// uncommitted messages.
+func TestFollowerReadsCommitted(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	subscription, err := broker.Subscribe(nil, "whatever", 0, 0, true)
+	t.AssertNil(err, "Subscribe")
+	t.AssertTrue(!subscription.uncommitted, "subscription.uncommitted")
+
+	t.AssertNil(broker.BecomeLeader("whatever"), "BecomeLeader")
+	subscription, err = broker.Subscribe(nil, "whatever", 0, 0, true)
+	t.AssertNil(err, "Subscribe")
+	t.AssertTrue(subscription.uncommitted, "subscription.uncommitted")
 
 }
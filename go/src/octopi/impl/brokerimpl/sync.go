@@ -3,68 +3,112 @@ package brokerimpl
 import (
 	"code.google.com/p/go.net/websocket"
 	"encoding/json"
+	"fmt"
+	"net"
 	"octopi/api/protocol"
 	"octopi/util/log"
+	"os"
+	"time"
 )
 
-// The Follower struct contains the connection, reported tails of the
-// follower's log files, and the host:port of the follower. The quit channel is
-// used to instruct the follower to stop syncing.
+// The Follower struct contains the connection, the followed partition,
+// reported tails of the follower's log files, and the host:port of the
+// follower. The quit channel is
+// used to instruct the follower to stop syncing. A follower is only counted
+// towards replication while it is in the in-sync set. Followers that do not
+// acknowledge within the session timeout are dropped.
 type Follower struct {
-	conn     *websocket.Conn   // open connection
-	tails    Offsets           // tails of log files
-	hostport protocol.HostPort // hostport of the follower
-	quit     chan interface{}  // quit channel
+	conn       *websocket.Conn   // open connection
+	replica    *Replica          // partition followed
+	tails      Offsets           // tails of log files
+	hostport   protocol.HostPort // hostport of the follower
+	quit       chan interface{}  // quit channel
+	insync     bool              // true iff follower is in the in-sync set
+	pending    int64             // number of published messages not yet acked
+	caughtUpAt time.Time         // last time follower was fully caught up
+	sentAt     time.Time         // last time follower was sent a sync
 }
 
-// SyncFollower streams updates to a follower through the given connection.
-// Once the follower has fully caught up, add it to the follower set.
-func (b *Broker) SyncFollower(conn *websocket.Conn, tails Offsets, hostport protocol.HostPort) error {
+// SyncFollower streams updates of a partition to a follower through the given
+// connection.
+// Once the follower has fully caught up, add it to the in-sync set. Followers
+// that fall behind are evicted from the in-sync set, but continue to receive
+// updates until they catch up again. Followers that have seen a newer leader
+// epoch are denied.
+func (b *Broker) SyncFollower(conn *websocket.Conn, request *protocol.FollowRequest) error {
 
 	follower := &Follower{
-		conn:     conn,
-		tails:    tails,
-		hostport: hostport,
-		quit:     make(chan interface{}, 1),
+		conn:       conn,
+		tails:      request.Offsets,
+		hostport:   request.HostPort,
+		quit:       make(chan interface{}, 1),
+		caughtUpAt: time.Now(),
 	}
 
-	if err := b.ackFollower(follower); nil != err {
+	if nil == follower.tails {
+		follower.tails = make(Offsets)
+	}
+
+	if err := b.ackFollower(follower, request); nil != err {
 		return err
 	}
 
+	b.addFollower(follower)
+	defer b.dropFollower(follower)
+
 	log.Debug("Begin synchronizing follower %v.", follower.hostport)
-	for !follower.caughtUp(b) {
+	for {
 		if err := follower.catchUp(b); nil != err {
 			return err
 		}
+		if err := follower.heartbeat(b); nil != err {
+			return err
+		}
+		if !follower.wait(b) {
+			return nil
+		}
 	}
 
-	log.Info("Follower %v has fully caught up.", follower.hostport)
-
-	<-follower.quit
-	return nil
-
 }
 
-// ackFollower sends an acknowledgement to the follower.
-func (b *Broker) ackFollower(f *Follower) error {
+// ackFollower sends an acknowledgement to the follower, instructing it to
+// truncate each log at the point where it diverges from the leader's. Returns
+// an error if the follow request was denied.
+func (b *Broker) ackFollower(f *Follower, request *protocol.FollowRequest) error {
 
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
 	ack := new(protocol.Ack)
-	if b.role != LEADER || f.conn.RemoteAddr().String() == b.Origin() {
-		log.Warn("Denying follow requests from %s.", f.conn.RemoteAddr())
+	r, exists := b.replicas[request.Partition]
+	if exists {
+		ack.Epoch = r.epoch
+	}
+
+	if !exists || r.role != LEADER || f.conn.RemoteAddr().String() == b.Origin() {
+		log.Warn("Denying follow requests for %s from %s.", request.Partition, f.conn.RemoteAddr())
+		ack.Status = protocol.StatusFailure
+	} else if request.Epoch > r.epoch {
+		log.Warn("Denying follow request from %s with newer epoch %d.", f.hostport, request.Epoch)
 		ack.Status = protocol.StatusFailure
 	} else {
 
+		f.replica = r
 		inner := new(protocol.FollowACK)
+		inner.Epoch = r.epoch
 		inner.Truncate = make(Offsets)
-		for topic, checkpoint := range b.checkpoints {
-			log.Info("Checkpoint is %v", checkpoint)
-			if f.tails[topic] > checkpoint {
-				inner.Truncate[topic] = checkpoint
-				f.tails[topic] = checkpoint
+		if tail, exists := f.tails[r.name]; exists {
+			var leader []protocol.EpochBoundary
+			var leaderTail int64
+			if t, exists := b.topics[r.name]; exists {
+				leader = t.boundaries()
+				leaderTail, _ = t.tail()
+			}
+			offset := divergence(leader, leaderTail, request.Epochs[r.name], tail)
+			if offset < tail {
+				log.Info("%v diverges from leader on %s at %d.", f.hostport, r.name, offset)
+				inner.Truncate[r.name] = offset
+				f.tails[r.name] = offset
 			}
 		}
 
@@ -73,71 +117,196 @@ func (b *Broker) ackFollower(f *Follower) error {
 
 	}
 
-	return websocket.JSON.Send(f.conn, ack)
+	if err := websocket.JSON.Send(f.conn, ack); nil != err {
+		return err
+	}
+
+	if ack.Status != protocol.StatusSuccess {
+		return fmt.Errorf("Denied follow request from %s.", f.hostport)
+	}
+
+	return nil
 
 }
 
-// caughtUp checks if the follower has really caught up, and adds it to the
-// broker's follower set.
-func (f *Follower) caughtUp(broker *Broker) bool {
+// addFollower adds the follower to the follower set of its partition,
+// replacing any previous connection from the same hostport.
+func (b *Broker) addFollower(f *Follower) {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// check if follower already in set. if so, delete prev entry.
+	for follower, _ := range f.replica.followers {
+		if f.hostport == follower.hostport {
+			b.removeFollower(follower)
+			follower.quit <- nil
+			follower.conn.Close()
+			f.replica.cond.Broadcast()
+		}
+	}
+
+	f.replica.followers[f] = true
+
+}
+
+// dropFollower removes the follower from the follower set of its partition.
+func (b *Broker) dropFollower(f *Follower) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.removeFollower(f)
+}
+
+// wait blocks until there is more for the follower to read, or it is due a
+// heartbeat. Returns false if the follower was instructed to quit.
+func (f *Follower) wait(broker *Broker) bool {
 
 	broker.lock.Lock()
 	defer broker.lock.Unlock()
 
-	//log.Info("Obtained lock for %v", f.hostport)
-
-	expected := broker.tails()
-	for topic, offset := range expected {
-		if offset != f.tails[topic] {
-			log.Debug("Not fully caught up yet for %s. %d -> %d", topic, f.tails[topic], offset)
+	for {
+		select {
+		case <-f.quit:
 			return false
+		default:
 		}
+		if !broker.checkFollower(f) || f.idle(broker) {
+			return true
+		}
+		f.replica.cond.Wait()
 	}
 
-	// check if follower already in set. if so, delete prev entry.
-	for follower, _ := range broker.followers {
-		if f.hostport == follower.hostport {
-			delete(broker.followers, follower)
+}
+
+// idle returns true iff the follower has not been sent anything for at least
+// the heartbeat interval.
+func (f *Follower) idle(broker *Broker) bool {
+	return time.Since(f.sentAt) >= broker.config.HeartbeatInterval()
+}
+
+// heartbeat sends a heartbeat to the follower if it is idle, so that it can
+// tell a quiet leader from a dead one, and learns the latest high watermark.
+// Returns an error if the follower does not acknowledge it in time.
+func (f *Follower) heartbeat(broker *Broker) error {
+
+	if !f.idle(broker) {
+		return nil
+	}
+
+	broker.lock.Lock()
+	sync := &protocol.Sync{Topic: f.replica.name, Epoch: f.replica.epoch, Heartbeat: true}
+	t, exists := broker.topics[f.replica.name]
+	broker.lock.Unlock()
+
+	if exists {
+		sync.Committed = t.committed()
+	}
+
+	if err := f.send(sync); nil != err {
+		return err
+	}
+
+	var ack protocol.SyncACK
+	return f.receive(broker, &ack)
+
+}
+
+// send sends the given sync to the follower.
+func (f *Follower) send(sync *protocol.Sync) error {
+	f.sentAt = time.Now()
+	return websocket.JSON.Send(f.conn, sync)
+}
+
+// receive waits for an acknowledgement from the follower, for at most the
+// session timeout.
+func (f *Follower) receive(broker *Broker, ack *protocol.SyncACK) error {
+	f.conn.SetReadDeadline(time.Now().Add(broker.config.SessionTimeout()))
+	return websocket.JSON.Receive(f.conn, ack)
+}
+
+// checkFollower updates the follower's lag, evicting it from the in-sync set
+// if it has fallen too far behind, and re-admitting it once it has fully
+// caught up. Returns true iff the follower is fully caught up. Caller must
+// hold the broker lock.
+func (b *Broker) checkFollower(f *Follower) bool {
+
+	if f.caughtUp(b) {
+		f.caughtUpAt = time.Now()
+		if !f.insync {
+			b.admitFollower(f)
 		}
+		return true
+	}
+
+	if !f.insync {
+		return false
+	}
+
+	if lag := time.Since(f.caughtUpAt); lag > b.config.MaxLagTime() {
+		log.Warn("Follower %v has not caught up on %s in %v.", f.hostport, f.replica.name, lag)
+		b.evictFollower(f)
+	} else if f.pending > b.config.MaxLagMessages() {
+		log.Warn("Follower %v is %d messages behind on %s.", f.hostport, f.pending, f.replica.name)
+		b.evictFollower(f)
 	}
 
-	// add to set of followers
-	broker.followers[f] = true
+	return false
 
-	// create struct to communicate with register
-	var addFollow protocol.InsyncChange
-	addFollow.Type = protocol.ADD
-	addFollow.HostPort = f.hostport
+}
+
+// monitorFollowers periodically checks the lag of every follower, so that
+// followers that stop acknowledging are evicted even if no messages are
+// published.
+func (b *Broker) monitorFollowers() {
+	for _ = range time.Tick(LAG_CHECK_INTERVAL * time.Millisecond) {
+		b.lock.Lock()
+		for _, r := range b.replicas {
+			for follower, _ := range r.followers {
+				b.checkFollower(follower)
+			}
+		}
+		b.lock.Unlock()
+	}
+}
+
+// caughtUp checks if the follower has really caught up. Caller must hold the
+// broker lock.
+func (f *Follower) caughtUp(broker *Broker) bool {
 
-	// add in-sync follower
-	// check if disconnect from register. if so, exit.
-	if err := websocket.JSON.Send(broker.regConn, addFollow); nil != err {
-		log.Warn("Unable to update register: %s.", err.Error())
+	name := f.replica.name
+	t, exists := broker.topics[name]
+	if !exists {
+		return true
+	}
+
+	offset, err := t.tail()
+	if nil != err {
+		log.Warn("Unable to get stats from log file for %s.", name)
+		return false
+	}
+
+	if offset != f.tails[name] {
+		log.Debug("Not fully caught up yet for %s. %d -> %d", name, f.tails[name], offset)
+		return false
 	}
 
 	return true
 
 }
 
-// catchUp tries to catch up the follower's log files with the leader's. If the
-// follower dies while catching up, the sync will be aborted.
+// catchUp tries to catch up the follower's log of the partition with the
+// leader's. If the follower dies while catching up, the sync will be aborted.
 func (f *Follower) catchUp(broker *Broker) error {
 
-	logs := make([]string, len(broker.logs))
-
 	broker.lock.Lock()
-	for topic, _ := range broker.logs {
-		logs = append(logs, topic)
-	}
+	_, exists := broker.topics[f.replica.name]
 	broker.lock.Unlock()
 
-	for _, topic := range logs {
-		if err := f.catchUpLog(broker, topic); nil != err {
-			return err
-		}
+	if !exists {
+		return nil
 	}
 
-	return nil
+	return f.catchUpLog(broker, f.replica.name)
 
 }
 
@@ -145,14 +314,27 @@ func (f *Follower) catchUp(broker *Broker) error {
 // it votes to abort the synchronization.
 func (f *Follower) catchUpLog(broker *Broker, topic string) error {
 
-	file, err := OpenLog(broker.config, topic, f.tails[topic])
+	broker.lock.Lock()
+	offset := f.tails[topic]
+	epoch := f.replica.epoch
+	t := broker.topics[topic]
+	broker.lock.Unlock()
+
+	file, err := OpenLog(broker.config, topic, offset)
 	if nil != err {
 		log.Warn("Could not open log file for topic: %s.", topic)
 		return err
 	}
 
 	defer file.Close()
-	var total uint32 = uint32(f.tails[topic])
+
+	// bootstrap far-behind followers with bulk transfers first
+	if err := f.catchUpSnapshot(broker, t, file, epoch); nil != err {
+		return err
+	}
+
+	offset, _ = file.Seek(0, os.SEEK_CUR)
+	var total uint32 = uint32(offset)
 	log.Debug("Started with %d.", total)
 
 	for {
@@ -164,8 +346,16 @@ func (f *Follower) catchUpLog(broker *Broker, topic string) error {
 		}
 
 		// send to follower
-		sync := &protocol.Sync{topic, entry.Message, entry.RequestId}
-		if err = websocket.JSON.Send(f.conn, sync); nil != err {
+		f.throttle(broker).Wait(int64(entry.length() + 4))
+		sync := &protocol.Sync{
+			Topic:      topic,
+			Message:    entry.Message,
+			RequestId:  entry.RequestId,
+			Epoch:      epoch,
+			EntryEpoch: t.epochAt(entry.ID),
+			Committed:  t.committed(),
+		}
+		if err = f.send(sync); nil != err {
 			return err
 		}
 
@@ -175,11 +365,11 @@ func (f *Follower) catchUpLog(broker *Broker, topic string) error {
 
 		// wait for ack
 		var ack protocol.SyncACK
-		if err = websocket.JSON.Receive(f.conn, &ack); nil != err {
+		if err = f.receive(broker, &ack); nil != err {
 			return err
 		}
 
-		f.tails[topic] = ack.Offset
+		f.acknowledged(broker, &ack)
 		log.Debug("%s is at %d.", f.conn.RemoteAddr(), ack.Offset)
 
 	}
@@ -188,66 +378,163 @@ func (f *Follower) catchUpLog(broker *Broker, topic string) error {
 
 }
 
-// catchUp tries to bring _this_ broker up to date with its leader.
-func (b *Broker) catchUp() error {
+// catchUpSnapshot sends the log to the follower in chunks of whole entries, for
+// as long as the follower is further behind than the snapshot threshold. This
+// is much faster than sending one entry at a time to new followers.
+func (f *Follower) catchUpSnapshot(broker *Broker, t *Topic, file *Log, epoch int64) error {
+
+	threshold := broker.config.SnapshotThreshold()
+	size := broker.config.SnapshotChunk()
+
+	for {
+
+		offset, err := file.Seek(0, os.SEEK_CUR)
+		if nil != err {
+			return err
+		}
+
+		tail, err := t.tail()
+		if nil != err {
+			return err
+		}
+
+		if tail-offset <= threshold {
+			return nil
+		}
+
+		chunk, err := file.ReadChunk(size)
+		if nil != err {
+			return err
+		}
+
+		// send to follower
+		f.throttle(broker).Wait(int64(len(chunk)))
+		sync := &protocol.Sync{
+			Topic:      t.name,
+			Epoch:      epoch,
+			Committed:  t.committed(),
+			Chunk:      chunk,
+			Boundaries: t.boundariesIn(offset, offset+int64(len(chunk))),
+		}
+		if err = f.send(sync); nil != err {
+			return err
+		}
+
+		// wait for ack
+		var ack protocol.SyncACK
+		if err = f.receive(broker, &ack); nil != err {
+			return err
+		}
+
+		f.acknowledged(broker, &ack)
+		log.Debug("Sent snapshot of %s to %s up to %d.", t.name, f.conn.RemoteAddr(), ack.Offset)
+
+	}
+
+}
+
+// throttle returns the throttle for traffic to the follower, which depends on
+// whether it is in the in-sync set or still catching up.
+func (f *Follower) throttle(broker *Broker) *Throttle {
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	if f.insync {
+		return broker.steady
+	}
+
+	return broker.lagging
+
+}
+
+// acknowledged records the offset acknowledged by the follower, and wakes up
+// any publishers waiting for replication.
+func (f *Follower) acknowledged(broker *Broker, ack *protocol.SyncACK) {
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	f.tails[ack.Topic] = ack.Offset
+	if f.pending > 0 {
+		f.pending--
+	}
+
+	f.replica.cond.Broadcast()
+
+}
+
+// catchUp tries to bring _this_ broker's log of the given partition up to date
+// with its leader.
+func (b *Broker) catchUp(r *Replica) error {
 
 	write := func(request *protocol.Sync) (int64, error) {
 
 		b.lock.Lock()
-		defer b.lock.Unlock()
+		stale := request.Epoch < r.epoch
+		b.lock.Unlock()
 
-		file, err := b.getOrOpenLog(request.Topic)
-		if nil != err {
-			return 0, err
+		if stale {
+			return 0, protocol.STALE
 		}
 
-		entry := &LogEntry{request.Message, request.RequestId}
-		if err = file.WriteNext(entry); nil != err {
+		topic, err := b.topic(request.Topic)
+		if nil != err {
 			return 0, err
 		}
 
-		stat, err := file.Stat()
-		log.Debug("File size on %s is %d.", b.Origin(), stat.Size())
+		var offset int64
+		if request.Heartbeat {
+			offset, err = topic.tail()
+		} else if 0 != len(request.Chunk) {
+			offset, err = topic.writeChunk(request.Chunk, request.Boundaries)
+		} else {
+			entry := &LogEntry{request.Message, request.RequestId}
+			offset, err = topic.write(entry, request.EntryEpoch)
+		}
 		if nil != err {
 			return 0, err
 		}
 
-		return stat.Size(), nil
+		log.Debug("File size on %s is %d.", b.Origin(), offset)
+		return offset, topic.commit(request.Committed)
 
 	}
 
 	for {
 
 		var request protocol.Sync
-		if err := b.leader.Receive(&request); nil != err {
-			log.Warn("Unable to receive from leader.")
+		if err := r.leader.Receive(&request); nil != err {
+			log.Warn("Unable to receive from leader of %s.", r.name)
 			return err
 		}
 
 		offset, err := write(&request)
-		if nil != err {
+		if protocol.STALE == err {
+			log.Warn("Ignoring leader with stale epoch %d.", request.Epoch)
+			return err
+		} else if nil != err {
 			log.Warn("Unable to open log file for %s.", request.Topic)
 			continue
 		}
 
 		ack := &protocol.SyncACK{request.Topic, offset}
-		if err := b.leader.Acknowledge(ack); nil != err {
+		if err := r.leader.Acknowledge(ack); nil != err {
 			log.Warn("Unable to ack leader: %s", err.Error())
 		}
 
-		b.cond.Broadcast()
-
 	}
 
 	return nil
 
 }
 
-func (b *Broker) failSafeCatchUp() {
-	//	err := b.catchUp()
-	//	if nil != err {
-	//		log.Warn("Changing leader %s", err.Error())
-	//		b.ChangeLeader()
-	//	}
-	b.catchUp()
+// failSafeCatchUp catches up with the leader of the given partition, and
+// re-registers if the leader turns out to be stale or stops sending heartbeats.
+func (b *Broker) failSafeCatchUp(r *Replica) {
+	err := b.catchUp(r)
+	if e, ok := err.(net.Error); protocol.STALE == err || (ok && e.Timeout()) {
+		log.Warn("Changing leader of %s: %s", r.name, err.Error())
+		b.ChangeLeader(r.name)
+	}
 }
@@ -0,0 +1,152 @@
+package brokerimpl
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"octopi/api/protocol"
+	"octopi/util/test"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestFollower creates an in-sync follower that has not received anything.
+func newTestFollower() *Follower {
+	return &Follower{
+		tails:      make(Offsets),
+		hostport:   "localhost:11113",
+		quit:       make(chan interface{}, 1),
+		insync:     true,
+		caughtUpAt: time.Now(),
+	}
+}
+
+// TestLagEviction ensures that followers that lag behind for too long are
+// evicted from the in-sync set, and re-admitted once they catch up.
+func TestLagEviction(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	config.Options["max_lag_time"] = "100"
+	register := newTestRegister()
+	defer register.Close()
+
+	log, err := OpenLog(config, "lag", 0)
+	t.AssertNil(err, "OpenLog")
+	t.AssertNil(log.WriteNext(&LogEntry{RequestId: []byte("x")}), "log.WriteNext")
+	log.Close()
+	defer os.Remove(log.Name())
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	t.AssertNil(broker.BecomeLeader("lag"), "BecomeLeader")
+	follower := newTestFollower()
+	broker.lock.Lock()
+	follower.replica = broker.replica("lag")
+	defer broker.lock.Unlock()
+
+	t.AssertTrue(!broker.checkFollower(follower), "checkFollower")
+	t.AssertTrue(follower.insync, "follower.insync")
+
+	follower.caughtUpAt = time.Now().Add(-time.Second)
+	broker.checkFollower(follower)
+	t.AssertTrue(!follower.insync, "follower.insync")
+
+	follower.tails = broker.tails()
+	t.AssertTrue(broker.checkFollower(follower), "checkFollower")
+	t.AssertTrue(follower.insync, "follower.insync")
+
+}
+
+// TestMessageLagEviction ensures that followers that are too many messages
+// behind are evicted from the in-sync set.
+func TestMessageLagEviction(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	config.Options["max_lag_messages"] = "5"
+	register := newTestRegister()
+	defer register.Close()
+
+	log, err := OpenLog(config, "lag", 0)
+	t.AssertNil(err, "OpenLog")
+	t.AssertNil(log.WriteNext(&LogEntry{RequestId: []byte("x")}), "log.WriteNext")
+	log.Close()
+	defer os.Remove(log.Name())
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	t.AssertNil(broker.BecomeLeader("lag"), "BecomeLeader")
+	follower := newTestFollower()
+	broker.lock.Lock()
+	follower.replica = broker.replica("lag")
+	defer broker.lock.Unlock()
+
+	follower.pending = 5
+	broker.checkFollower(follower)
+	t.AssertTrue(follower.insync, "follower.insync")
+
+	follower.pending = 6
+	broker.checkFollower(follower)
+	t.AssertTrue(!follower.insync, "follower.insync")
+
+}
+
+// TestHeartbeat ensures that idle followers are sent heartbeats, and that
+// followers that do not acknowledge them in time are given up on.
+func TestHeartbeat(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	config.Options["heartbeat_interval"] = "50"
+	config.Options["session_timeout"] = "200"
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+
+	beats := 0
+	answer := func(conn *websocket.Conn) {
+		defer conn.Close()
+		var sync protocol.Sync
+		for nil == websocket.JSON.Receive(conn, &sync) {
+			if sync.Heartbeat {
+				beats++
+			}
+			websocket.JSON.Send(conn, &protocol.SyncACK{Topic: sync.Topic})
+		}
+	}
+	ignore := func(conn *websocket.Conn) {
+		defer conn.Close()
+		var sync protocol.Sync
+		for nil == websocket.JSON.Receive(conn, &sync) {
+		}
+	}
+
+	for _, f := range []func(*websocket.Conn){answer, ignore} {
+
+		client, listener := newTestClient(t, f)
+		follower := newTestFollower()
+		follower.conn = client
+		broker.lock.Lock()
+		follower.replica = broker.replica("beat")
+		broker.lock.Unlock()
+
+		t.AssertTrue(follower.idle(broker), "follower.idle")
+		err := follower.heartbeat(broker)
+		if 0 == beats {
+			t.AssertNotNil(err, "follower.heartbeat")
+		} else {
+			t.AssertNil(err, "follower.heartbeat")
+			t.AssertTrue(!follower.idle(broker), "follower.idle")
+		}
+
+		client.Close()
+		listener.Close()
+		beats = 0
+
+	}
+
+}
@@ -0,0 +1,72 @@
+package brokerimpl
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttles limit the rate at which bytes are sent, by spacing transfers out
+// over time. The rate may be changed while transfers are in progress.
+// Thread-safe.
+type Throttle struct {
+	rate int64      // bytes per second; unlimited if not positive
+	next time.Time  // time at which the next transfer may start
+	lock sync.Mutex // lock
+}
+
+// NewThrottle creates a throttle with the given rate in bytes per second.
+func NewThrottle(rate int64) *Throttle {
+	return &Throttle{rate: rate}
+}
+
+// Rate returns the rate of the throttle in bytes per second.
+func (t *Throttle) Rate() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rate
+}
+
+// SetRate changes the rate of the throttle. A rate that is not positive
+// removes the limit. Bytes already sent that are still being paid for are
+// paid for at the new rate, so that lowering the limit takes effect
+// immediately, and raising it does not leave transfers waiting out the old
+// rate.
+func (t *Throttle) SetRate(rate int64) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if t.rate > 0 && rate > 0 && t.next.After(now) {
+		owed := t.next.Sub(now) * time.Duration(t.rate) / time.Duration(rate)
+		t.next = now.Add(owed)
+	} else {
+		t.next = now
+	}
+
+	t.rate = rate
+
+}
+
+// Wait blocks until n more bytes may be sent.
+func (t *Throttle) Wait(n int64) {
+
+	t.lock.Lock()
+
+	if t.rate <= 0 {
+		t.lock.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+	t.lock.Unlock()
+
+	time.Sleep(delay)
+
+}
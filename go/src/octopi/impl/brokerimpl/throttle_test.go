@@ -0,0 +1,37 @@
+package brokerimpl
+
+import (
+	"octopi/util/test"
+	"testing"
+	"time"
+)
+
+// TestThrottle ensures that throttles space transfers out according to their
+// rate, and that raising or removing the limit takes effect immediately.
+func TestThrottle(tester *testing.T) {
+
+	t := test.New(tester)
+	throttle := NewThrottle(1000)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		throttle.Wait(500)
+	}
+
+	// the third transfer starts after the first two have taken a second
+	elapsed := time.Since(start)
+	t.AssertTrue(elapsed >= time.Second, "throttle.Wait")
+
+	// the debt of a transfer is rescaled when the rate is raised
+	throttle.Wait(10000)
+	throttle.SetRate(1000000)
+	start = time.Now()
+	throttle.Wait(1)
+	t.AssertTrue(time.Since(start) < 100*time.Millisecond, "throttle.Wait")
+
+	throttle.SetRate(0)
+	start = time.Now()
+	throttle.Wait(1 << 30)
+	t.AssertTrue(time.Since(start) < 100*time.Millisecond, "throttle.Wait")
+
+}
@@ -0,0 +1,403 @@
+package brokerimpl
+
+import (
+	"errors"
+	"octopi/api/protocol"
+	"os"
+	"sync"
+	"time"
+)
+
+// Topics hold the state of a single topic: its log, the epoch boundaries and
+// high watermark of the log, and its subscriptions. Each topic has its own
+// lock, so that unrelated topics can be published to in parallel, and its own
+// conditional variable, so that a write to one topic only wakes up its own
+// subscribers.
+type Topic struct {
+	name          string             // name of topic
+	log           *Log               // log file, positioned at the tail
+	epochs        *Epochs            // epoch boundaries of the log
+	hw            *Watermark         // high watermark of the log
+	subscriptions SubscriptionSet    // set of subscriptions
+	writers       map[string]*Writer // producers that have written to the topic
+	lock          sync.Mutex         // lock to manage topic access
+	cond          *sync.Cond         // conditional variable for new messages
+}
+
+// Max number of producers whose messages are tracked by each topic.
+const MAX_WRITERS = 1024
+
+// OUT_OF_ORDER is the error returned for batches with a message whose ID is no
+// higher than that of a message already written by its producer, and that is
+// not a resend of the producer's last request.
+var OUT_OF_ORDER = errors.New("Message ID is not higher than the producer's last.")
+
+// Writers track the messages that a producer has written to a topic, so that
+// messages that are resent after a failure are not written again.
+type Writer struct {
+	id      int64           // highest message ID written
+	offsets map[int64]int64 // offsets of the messages of the last request
+	used    time.Time       // time of the last request
+}
+
+// openTopic opens the log, epochs and watermark files for the given topic.
+func openTopic(config *Config, name string) (*Topic, error) {
+
+	file, err := OpenLog(config, name, -1)
+	if nil != err {
+		return nil, err
+	}
+
+	epochs, err := OpenEpochs(config, name)
+	if nil != err {
+		file.Close()
+		return nil, err
+	}
+
+	hw, err := OpenWatermark(config, name)
+	if nil != err {
+		file.Close()
+		epochs.Close()
+		return nil, err
+	}
+
+	t := &Topic{
+		name:          name,
+		log:           file,
+		epochs:        epochs,
+		hw:            hw,
+		subscriptions: make(SubscriptionSet),
+		writers:       make(map[string]*Writer),
+	}
+
+	t.cond = sync.NewCond(&t.lock)
+	return t, nil
+
+}
+
+// publish appends the given message from the given producer to the log, and
+// wakes up subscribers. Returns the tail of the log after the append.
+func (t *Topic) publish(producer string, msg *protocol.Message, epoch int64) (int64, error) {
+	_, tail, err := t.publishBatch(producer, []protocol.Message{*msg}, epoch)
+	return tail, err
+}
+
+// publishBatch appends the given messages from the given producer to the log
+// in order, and wakes up subscribers. Returns the offset of each message, and
+// the tail of the log after the appends. Messages of the producer's last
+// request, or of the last entry of the log, are dropped, and have the offset
+// of the entry already written. If
+// any other message has an ID no higher than that of a message already
+// written by the producer, nothing is written and OUT_OF_ORDER is returned.
+func (t *Topic) publishBatch(producer string, msgs []protocol.Message, epoch int64) ([]int64, int64, error) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	w := t.writer(producer)
+	if nil != w.offsets {
+		highest := w.id
+		for i := range msgs {
+			id := msgs[i].ID
+			if _, resent := w.offsets[id]; resent && id <= w.id {
+				continue
+			}
+			if id <= highest {
+				return nil, 0, OUT_OF_ORDER
+			}
+			highest = id
+		}
+	}
+
+	offsets := make([]int64, len(msgs))
+	written := make(map[int64]int64, len(msgs))
+	marked := false
+
+	for i := range msgs {
+
+		id := msgs[i].ID
+		if offset, resent := w.offsets[id]; resent && id <= w.id {
+			offsets[i] = offset
+			written[id] = offset
+			continue
+		}
+
+		// the last entry may have been written before the log was reopened
+		if t.log.IsLast(producer, &msgs[i]) {
+			w.id = id
+			offsets[i] = t.log.lastOffset
+			written[id] = offsets[i]
+			continue
+		}
+
+		// only entries written in the epoch start a boundary
+		if !marked {
+			if err := t.mark(epoch); nil != err {
+				w.offsets = written
+				return nil, 0, err
+			}
+			marked = true
+		}
+
+		if _, err := t.log.Append(producer, &msgs[i]); nil != err {
+			w.offsets = written
+			return nil, 0, err
+		}
+
+		w.id = id
+		offsets[i] = t.log.lastOffset
+		written[id] = offsets[i]
+
+	}
+
+	w.offsets = written
+
+	t.cond.Broadcast()
+	tail, err := t.log.Seek(0, os.SEEK_CUR)
+	return offsets, tail, err
+
+}
+
+// writer returns the writer of the given producer, and forgets the least
+// recently used writer if there are too many. Caller must hold the topic lock.
+func (t *Topic) writer(producer string) *Writer {
+
+	if w, exists := t.writers[producer]; exists {
+		w.used = time.Now()
+		return w
+	}
+
+	if len(t.writers) >= MAX_WRITERS {
+		var oldest string
+		for name, w := range t.writers {
+			if "" == oldest || w.used.Before(t.writers[oldest].used) {
+				oldest = name
+			}
+		}
+		delete(t.writers, oldest)
+	}
+
+	w := &Writer{used: time.Now()}
+	t.writers[producer] = w
+	return w
+
+}
+
+// write writes the given entry, written by the leader in the given epoch, to
+// the log and wakes up subscribers. Returns the tail of the log after the
+// write.
+func (t *Topic) write(entry *LogEntry, epoch int64) (int64, error) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err := t.mark(epoch); nil != err {
+		return 0, err
+	}
+
+	if err := t.log.WriteNext(entry); nil != err {
+		return 0, err
+	}
+
+	t.cond.Broadcast()
+	return t.log.Seek(0, os.SEEK_CUR)
+
+}
+
+// writeChunk writes the given chunk of whole entries, copied from the leader's
+// log, to the log and wakes up subscribers. The given epoch boundaries of the
+// leader's log within the chunk are recorded. Returns the tail of the log
+// after the write.
+func (t *Topic) writeChunk(chunk []byte, boundaries []protocol.EpochBoundary) (int64, error) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, boundary := range boundaries {
+		if err := t.epochs.Mark(boundary.Epoch, boundary.Offset); nil != err {
+			return 0, err
+		}
+	}
+
+	if err := t.log.WriteChunk(chunk); nil != err {
+		return 0, err
+	}
+
+	t.cond.Broadcast()
+	return t.log.Seek(0, os.SEEK_CUR)
+
+}
+
+// mark records that entries from the current tail onwards are written in the
+// given epoch. Caller must hold the topic lock.
+func (t *Topic) mark(epoch int64) error {
+
+	offset, err := t.log.Seek(0, os.SEEK_CUR)
+	if nil != err {
+		return err
+	}
+
+	return t.epochs.Mark(epoch, offset)
+
+}
+
+// commit raises the high watermark to the given offset, or to the tail of the
+// log if that is lower, and wakes up subscribers.
+func (t *Topic) commit(offset int64) error {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tail, err := t.log.Seek(0, os.SEEK_CUR)
+	if nil != err {
+		return err
+	}
+
+	if tail < offset {
+		offset = tail
+	}
+
+	if offset <= t.hw.Offset() {
+		return nil
+	}
+
+	if err := t.hw.Set(offset); nil != err {
+		return err
+	}
+
+	t.cond.Broadcast()
+	return nil
+
+}
+
+// committed returns the high watermark of the log.
+func (t *Topic) committed() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.hw.Offset()
+}
+
+// readable returns true iff the subscription may read the next entry: either
+// it reads uncommitted entries, or it is below the high watermark.
+func (t *Topic) readable(s *Subscription) bool {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return s.uncommitted || s.offset() < t.hw.Offset()
+
+}
+
+// wait checks if the subscription is really at the end of the log, or at the
+// high watermark if it only reads committed entries. It returns iff there is
+// more to be read, or the topic was signalled.
+func (t *Topic) wait(s *Subscription) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if s.log.IsEOF() || (!s.uncommitted && s.offset() >= t.hw.Offset()) {
+		t.cond.Wait()
+	}
+
+}
+
+// tail returns the size of the log file.
+func (t *Topic) tail() (int64, error) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stat, err := t.log.Stat()
+	if nil != err {
+		return 0, err
+	}
+
+	return stat.Size(), nil
+
+}
+
+// boundaries returns the epoch boundaries of the log.
+func (t *Topic) boundaries() []protocol.EpochBoundary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.epochs.Boundaries()
+}
+
+// boundariesIn returns the epoch boundaries of the log between the given
+// offsets, starting with the epoch in effect at the start.
+func (t *Topic) boundariesIn(start int64, end int64) []protocol.EpochBoundary {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	boundaries := []protocol.EpochBoundary{{t.epochs.At(start), start}}
+	for _, boundary := range t.epochs.Boundaries() {
+		if boundary.Offset > start && boundary.Offset < end {
+			boundaries = append(boundaries, boundary)
+		}
+	}
+
+	return boundaries
+
+}
+
+// epochAt returns the epoch in which the entry at the given offset was
+// written.
+func (t *Topic) epochAt(offset int64) int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.epochs.At(offset)
+}
+
+// truncate truncates the log and its epochs at the given offset, and reopens
+// them. The high watermark is lowered to the offset if it is higher.
+func (t *Topic) truncate(config *Config, offset int64) error {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.log.Close()
+	t.epochs.Close()
+
+	if err := truncateLog(config, t.name, offset); nil != err {
+		return err
+	}
+
+	if err := truncateEpochs(config, t.name, offset); nil != err {
+		return err
+	}
+
+	if t.hw.Offset() > offset {
+		if err := t.hw.Set(offset); nil != err {
+			return err
+		}
+	}
+
+	file, err := OpenLog(config, t.name, -1)
+	if nil != err {
+		return err
+	}
+
+	epochs, err := OpenEpochs(config, t.name)
+	if nil != err {
+		file.Close()
+		return err
+	}
+
+	// messages that were written may be gone
+	t.log = file
+	t.epochs = epochs
+	t.writers = make(map[string]*Writer)
+	return nil
+
+}
+
+// close closes the log, epochs and watermark files.
+func (t *Topic) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.log.Close()
+	t.epochs.Close()
+	t.hw.Close()
+}
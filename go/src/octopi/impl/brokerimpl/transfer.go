@@ -0,0 +1,65 @@
+package brokerimpl
+
+import (
+	"fmt"
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"time"
+)
+
+// Transfer hands leadership of the given partition to the given in-sync
+// follower, without losing acknowledged writes. New publishes are refused, and
+// once those in progress have completed and the follower has caught up with
+// the whole log, the register is asked to elect the follower and this broker
+// steps down. Writes resume on this broker if the follower does not catch up
+// within the session timeout, or if the register cannot be asked.
+func (b *Broker) Transfer(name string, target string) error {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r, exists := b.replicas[name]
+	if !exists || LEADER != r.role {
+		return NOT_LEADER
+	}
+
+	if r.transferring {
+		return fmt.Errorf("Leadership of %s is already being transferred.", name)
+	}
+
+	var follower *Follower
+	for f, _ := range r.followers {
+		if string(f.hostport) == target && f.insync {
+			follower = f
+		}
+	}
+
+	if nil == follower {
+		return fmt.Errorf("%s is not an in-sync follower of %s.", target, name)
+	}
+
+	log.Info("Transferring leadership of %s to %s.", name, target)
+	r.transferring = true
+	defer func() { r.transferring = false }()
+
+	// heartbeats wake this up periodically, so the deadline is noticed
+	deadline := time.Now().Add(b.config.SessionTimeout())
+	for r.publishing > 0 || !follower.caughtUp(b) {
+		if LEADER != r.role || !r.followers[follower] || time.Now().After(deadline) {
+			return fmt.Errorf("%s did not catch up on %s in time.", target, name)
+		}
+		r.cond.Wait()
+	}
+
+	// without the handoff, the partition would have no leader until the
+	// register gives up on this broker, so keep leading instead
+	handoff := &protocol.InsyncChange{Type: protocol.HANDOFF, HostPort: protocol.HostPort(target)}
+	if err := b.notifyRegister(r, handoff); nil != err {
+		return fmt.Errorf("Unable to hand off %s: %s", name, err.Error())
+	}
+	b.stepDown(r)
+
+	log.Info("Handed leadership of %s to %s.", name, target)
+	return nil
+
+}
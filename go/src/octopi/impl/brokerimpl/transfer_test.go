@@ -0,0 +1,71 @@
+package brokerimpl
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"octopi/api/protocol"
+	"octopi/util/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTransfer ensures that leadership is only handed off to in-sync
+// followers that have caught up, after which the leader steps down, and that
+// the leader keeps leading if the register cannot be told.
+func TestTransfer(tester *testing.T) {
+
+	t := test.New(tester)
+	config := newTestConfig()
+	config.Options["session_timeout"] = "200"
+	register := newTestRegister()
+	defer register.Close()
+
+	broker, err := New(&config.Config)
+	t.AssertNil(err, "New")
+	t.AssertNotNil(broker.Transfer("handoff", "localhost:11113"), "Transfer")
+
+	t.AssertNil(broker.BecomeLeader("handoff"), "BecomeLeader")
+	defer os.Remove(filepath.Join(config.LogDir(), "handoff"+EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "handoff"+EPOCHS_EXT))
+	defer os.Remove(filepath.Join(config.LogDir(), "handoff"+WATERMARK_EXT))
+
+	offset, err := broker.Publish("handoff", 0, "x", &protocol.Message{ID: 1})
+	t.AssertNil(err, "Publish")
+	t.AssertEqual(new(test.IntMatcher), 0, int(offset))
+
+	client, listener := newTestClient(t, func(conn *websocket.Conn) {})
+	defer client.Close()
+	defer listener.Close()
+
+	follower := newTestFollower()
+	follower.conn = client
+	broker.lock.Lock()
+	follower.replica = broker.replica("handoff")
+	follower.replica.followers[follower] = true
+	broker.lock.Unlock()
+
+	// the follower has not caught up
+	t.AssertNotNil(broker.Transfer("handoff", "localhost:11113"), "Transfer")
+
+	broker.lock.Lock()
+	follower.tails = broker.tails()
+	broker.lock.Unlock()
+
+	t.AssertNotNil(broker.Transfer("handoff", "localhost:11114"), "Transfer")
+
+	// without the register, the leader keeps leading
+	broker.lock.Lock()
+	regConn := follower.replica.regConn
+	follower.replica.regConn = nil
+	broker.lock.Unlock()
+	t.AssertNotNil(broker.Transfer("handoff", "localhost:11113"), "Transfer")
+	broker.lock.Lock()
+	t.AssertTrue(LEADER == follower.replica.role, "role")
+	t.AssertTrue(!follower.replica.transferring, "transferring")
+	follower.replica.regConn = regConn
+	broker.lock.Unlock()
+	t.AssertNil(broker.Transfer("handoff", "localhost:11113"), "Transfer")
+	_, err = broker.Publish("handoff", 0, "x", &protocol.Message{ID: 2})
+	t.AssertTrue(NOT_LEADER == err, "Publish")
+
+}
@@ -0,0 +1,92 @@
+package brokerimpl
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Watermarks record the high watermark of a topic log: the offset up to which
+// every entry has been acknowledged by all in-sync followers, and so survives
+// a leader transition. Entries past the high watermark are uncommitted. Not
+// thread-safe; the topic lock guards it.
+type Watermark struct {
+	file   *os.File // watermark file
+	offset int64    // high watermark
+}
+
+// Watermark file extension.
+const WATERMARK_EXT = ".hw"
+
+// OpenWatermark opens the watermark file for the given topic. Logs written
+// before watermarks were recorded are treated as fully committed.
+func OpenWatermark(config *Config, topic string) (*Watermark, error) {
+
+	name := filepath.Join(config.LogDir(), topic+WATERMARK_EXT)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, perm)
+	if nil != err {
+		return nil, err
+	}
+
+	w := &Watermark{file: file}
+	err = binary.Read(file, binary.LittleEndian, &w.offset)
+	switch err {
+	case nil:
+	case io.EOF:
+		stat, err := os.Stat(filepath.Join(config.LogDir(), topic+EXT))
+		if nil == err && stat.Size() > 0 {
+			w.Set(stat.Size())
+		}
+	default:
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+
+}
+
+// truncateWatermark lowers the high watermark of the given topic to the given
+// offset, if it is higher.
+func truncateWatermark(config *Config, topic string, offset int64) error {
+
+	w, err := OpenWatermark(config, topic)
+	if nil != err {
+		return err
+	}
+
+	defer w.Close()
+	if w.Offset() <= offset {
+		return nil
+	}
+
+	return w.Set(offset)
+
+}
+
+// Offset returns the high watermark.
+func (w *Watermark) Offset() int64 {
+	return w.offset
+}
+
+// Set records the given offset as the high watermark.
+func (w *Watermark) Set(offset int64) error {
+
+	if _, err := w.file.Seek(0, os.SEEK_SET); nil != err {
+		return err
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, offset); nil != err {
+		return err
+	}
+
+	w.offset = offset
+	return nil
+
+}
+
+// Close closes the watermark file.
+func (w *Watermark) Close() error {
+	return w.file.Close()
+}
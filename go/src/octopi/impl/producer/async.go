@@ -0,0 +1,335 @@
+package producer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"sync"
+	"time"
+)
+
+// Defaults of asynchronous producers.
+const (
+	BATCH_SIZE  = 100              // max number of messages in a batch
+	LINGER      = 5                // max ms that a message waits for its batch to fill
+	BUFFER_SIZE = 32 * 1024 * 1024 // max bytes of payloads awaiting acknowledgement
+)
+
+// BUFFER_FULL is the error returned by sends of asynchronous producers that are
+// configured to fail, rather than block, when their buffer is full.
+var BUFFER_FULL = errors.New("Producer buffer is full.")
+
+// CLOSED is the error returned by sends of asynchronous producers that have
+// been closed.
+var CLOSED = errors.New("Producer is closed.")
+
+// AsyncOptions configure asynchronous producers. Zero values are replaced by
+// defaults.
+type AsyncOptions struct {
+	BatchSize int           // max number of messages in a batch
+	Linger    time.Duration // max time a message waits for its batch to fill
+	Buffer    int           // max bytes of payloads awaiting acknowledgement
+	Fail      bool          // fail with BUFFER_FULL instead of blocking when full
+}
+
+// AsyncProducers queue messages for each partition of each topic, and send
+// them to brokers in batches, so that a send does not wait for a round trip. A
+// batch is sent once it is full, or once its oldest message has waited for the
+// linger time. The batches of a partition are sent one at a time and in order,
+// while different partitions are sent in parallel.
+type AsyncProducer struct {
+	producer *Producer         // holds sequence numbers and partitioner
+	options  AsyncOptions      // batching and buffering options
+	queues   map[string]*queue // queued messages of each partition
+	buffered int               // bytes of payloads awaiting acknowledgement
+	closed   bool              // true once Close is invoked
+	senders  sync.WaitGroup    // one sender for each partition
+	lock     sync.Mutex        // lock for producer state
+	cond     *sync.Cond        // signalled when messages are queued or acknowledged
+}
+
+// Queues hold the messages of a partition that have not been sent yet.
+type queue struct {
+	topic     string    // name of topic
+	partition int       // partition of topic
+	records   []*record // messages, oldest first
+	first     time.Time // time at which the oldest message was queued
+}
+
+// Records are queued messages along with their futures.
+type record struct {
+	message protocol.Message
+	future  *Future
+}
+
+// Futures hold the outcome of asynchronous sends.
+type Future struct {
+	done     chan bool          // closed once the outcome is known
+	position *protocol.Position // position at which the message was written
+	err      error              // error, if the message was not written
+}
+
+// NewAsync creates a new asynchronous producer that sends messages to the
+// leaders of the partitions, as found by the register or broker at the given
+// hostport, in the same way as New.
+func NewAsync(hostport string, id *string, options AsyncOptions) *AsyncProducer {
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = BATCH_SIZE
+	}
+
+	if options.Linger <= 0 {
+		options.Linger = LINGER * time.Millisecond
+	}
+
+	if options.Buffer <= 0 {
+		options.Buffer = BUFFER_SIZE
+	}
+
+	a := &AsyncProducer{
+		producer: New(hostport, id),
+		options:  options,
+		queues:   make(map[string]*queue),
+	}
+
+	a.cond = sync.NewCond(&a.lock)
+	return a
+
+}
+
+// SetPartitioner configures the number of partitions of each topic, and the
+// partitioner used to choose among them, as for Producer.
+func (a *AsyncProducer) SetPartitioner(partitions int, partitioner Partitioner) {
+	a.producer.SetPartitioner(partitions, partitioner)
+}
+
+// Send queues the message for the topic, and returns its future.
+func (a *AsyncProducer) Send(topic string, payload []byte) (*Future, error) {
+	return a.SendKey(topic, nil, payload)
+}
+
+// SendKey queues the message for the partition of the topic chosen by the
+// partitioner for the given key, and returns its future. If the buffer is
+// full, it blocks until enough messages have been acknowledged, or returns
+// BUFFER_FULL if the producer is configured to fail instead. A message larger
+// than the whole buffer is accepted once the buffer is empty.
+func (a *AsyncProducer) SendKey(topic string, key []byte, payload []byte) (*Future, error) {
+
+	a.producer.lock.Lock()
+	partition := a.producer.partitioner(key, a.producer.partitions)
+	a.producer.lock.Unlock()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for !a.closed && a.buffered > 0 && a.buffered+len(payload) > a.options.Buffer {
+		if a.options.Fail {
+			return nil, BUFFER_FULL
+		}
+		a.cond.Wait()
+	}
+
+	if a.closed {
+		return nil, CLOSED
+	}
+
+	name := protocol.PartitionName(topic, partition)
+	q, exists := a.queues[name]
+	if !exists {
+		q = &queue{topic: topic, partition: partition}
+		a.queues[name] = q
+		a.senders.Add(1)
+		go a.sender(q)
+	}
+
+	if 0 == len(q.records) {
+		q.first = time.Now()
+		time.AfterFunc(a.options.Linger, a.wake)
+	}
+
+	// sequence numbers are taken in the order messages are queued, so that
+	// they reach brokers in order
+	a.producer.seqnum++
+	message := protocol.Message{a.producer.seqnum, payload, crc32.ChecksumIEEE(payload), nil}
+	future := &Future{done: make(chan bool)}
+	q.records = append(q.records, &record{message, future})
+	a.buffered += len(payload)
+	a.cond.Broadcast()
+
+	return future, nil
+
+}
+
+// Close sends all queued messages, and waits for them to be acknowledged or to
+// fail before closing the producer's websocket connections. Sends that are
+// made after Close fail with CLOSED.
+func (a *AsyncProducer) Close() {
+
+	a.lock.Lock()
+	a.closed = true
+	a.cond.Broadcast()
+	a.lock.Unlock()
+
+	a.senders.Wait()
+	a.producer.Close()
+
+}
+
+// wake wakes up senders, so that they see batches that have lingered.
+func (a *AsyncProducer) wake() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.cond.Broadcast()
+}
+
+// sender sends the batches of the given partition until the producer is
+// closed and the queue is empty.
+func (a *AsyncProducer) sender(q *queue) {
+
+	defer a.senders.Done()
+
+	socket := &protocol.Socket{
+		HostPort:  a.producer.registers[0],
+		Path:      protocol.PUBLISH,
+		Origin:    origin(),
+		Registers: a.producer.registers,
+	}
+	defer socket.Close()
+
+	for batch := a.next(q); nil != batch; batch = a.next(q) {
+
+		receipt, err := a.send(socket, q, batch)
+
+		size := 0
+		for i, r := range batch {
+			size += len(r.message.Payload)
+			if nil != err {
+				r.future.complete(nil, err)
+			} else {
+				position := &protocol.Position{receipt.Topic, receipt.Partition, receipt.Offsets[i]}
+				r.future.complete(position, nil)
+			}
+		}
+
+		a.lock.Lock()
+		a.buffered -= size
+		a.cond.Broadcast()
+		a.lock.Unlock()
+
+	}
+
+}
+
+// next blocks until a batch of the given queue is ready to be sent, and removes
+// it from the queue. Returns nil once the producer is closed and the queue is
+// empty.
+func (a *AsyncProducer) next(q *queue) []*record {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for !a.ready(q) {
+		a.cond.Wait()
+	}
+
+	if 0 == len(q.records) {
+		return nil
+	}
+
+	n := len(q.records)
+	if n > a.options.BatchSize {
+		n = a.options.BatchSize
+	}
+
+	batch := q.records[:n]
+	q.records = q.records[n:]
+	return batch
+
+}
+
+// ready returns true iff a batch of the given queue should be sent now, or the
+// producer is closed. Caller must hold the lock.
+func (a *AsyncProducer) ready(q *queue) bool {
+	switch {
+	case a.closed || len(q.records) >= a.options.BatchSize:
+		return true
+	case 0 == len(q.records):
+		return false
+	}
+	return time.Since(q.first) >= a.options.Linger
+}
+
+// send sends the batch to the leader of the partition, and resends it until it
+// is acknowledged or refused, or MAX_RETRIES resends have failed. The broker
+// drops messages of the batch that it has already written, so resending it
+// does not duplicate them. Returns the receipt, with the offset of each
+// message.
+func (a *AsyncProducer) send(socket *protocol.Socket, q *queue, batch []*record) (*protocol.ProduceReceipt, error) {
+
+	messages := make([]protocol.Message, len(batch))
+	for i, r := range batch {
+		messages[i] = r.message
+	}
+
+	request := &protocol.ProduceRequest{
+		ID:        a.producer.id,
+		Topic:     q.topic,
+		Partition: q.partition,
+		Messages:  messages,
+	}
+
+	log.Debug("Sending batch of %d messages to %s.", len(messages), q.topic)
+
+	var err error
+	for attempt := 0; attempt <= MAX_RETRIES; attempt++ {
+
+		var payload []byte
+		payload, err = socket.Send(request, MAX_RETRIES, origin())
+		switch err {
+		case nil:
+		case protocol.REFUSED:
+			return nil, err
+		default:
+			socket.Reset(a.producer.registers[0])
+			continue
+		}
+
+		receipt := new(protocol.ProduceReceipt)
+		if err := json.Unmarshal(payload, receipt); nil != err {
+			return nil, err
+		}
+
+		if len(receipt.Offsets) != len(batch) {
+			return nil, fmt.Errorf("Expected %d offsets, was %d.", len(batch), len(receipt.Offsets))
+		}
+
+		return receipt, nil
+
+	}
+
+	return nil, err
+
+}
+
+// Done returns a channel that is closed once the message has been
+// acknowledged, or has failed.
+func (f *Future) Done() <-chan bool {
+	return f.done
+}
+
+// Wait blocks until the message has been acknowledged, and returns the
+// position at which it was written, or the error if it failed.
+func (f *Future) Wait() (*protocol.Position, error) {
+	<-f.done
+	return f.position, f.err
+}
+
+// complete records the outcome of the send, and wakes up waiters.
+func (f *Future) complete(position *protocol.Position, err error) {
+	f.position = position
+	f.err = err
+	close(f.done)
+}
@@ -0,0 +1,33 @@
+package producer
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// Partitioners choose the partition of a topic that a message is sent to,
+// given the message's key and the number of partitions. Custom partitioners
+// may be used as long as they return a number in [0, partitions).
+type Partitioner func(key []byte, partitions int) int
+
+// HashPartitioner sends messages with the same key to the same partition.
+// Messages without a key are spread round-robin across the partitions, rather
+// than all hashed to the same one.
+func HashPartitioner(key []byte, partitions int) int {
+	if 0 == len(key) {
+		return keyless(key, partitions)
+	}
+	return int(crc32.ChecksumIEEE(key) % uint32(partitions))
+}
+
+// keyless chooses partitions for messages sent without a key.
+var keyless = RoundRobinPartitioner()
+
+// RoundRobinPartitioner returns a partitioner that ignores keys and cycles
+// through the partitions.
+func RoundRobinPartitioner() Partitioner {
+	var next uint32
+	return func(key []byte, partitions int) int {
+		return int((atomic.AddUint32(&next, 1) - 1) % uint32(partitions))
+	}
+}
@@ -2,6 +2,8 @@ package producer
 
 import (
 	crand "crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"math"
@@ -11,21 +13,29 @@ import (
 	"octopi/util/log"
 	"os"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 // Producers publish messages to brokers.
 type Producer struct {
-	socket   *protocol.Socket // protocol socket
-	register string           // hostport of register
-	seqnum   int64            // sequence number of messages
-	lock     sync.Mutex       // lock for producer state
-	id       string           // producer ID
+	sockets     map[string]*protocol.Socket // sockets to partition leaders
+	registers   []string                    // hostports of registers
+	seqnum      int64                       // sequence number of messages
+	explicit    bool                        // true once SendID is used
+	sent        bool                        // true once a message is sent
+	lock        sync.Mutex                  // lock for producer state
+	id          string                      // producer ID
+	partitions  int                         // number of partitions of each topic
+	partitioner Partitioner                 // chooses partitions for messages
 }
 
 // Max number of retries.
 const MAX_RETRIES = 5
 
+// MIXED_IDS is the error returned by sends that mix IDs given to SendID with
+// sequence numbers on the same producer.
+var MIXED_IDS = errors.New("Producer cannot mix SendID with other sends.")
+
 // seed seeds the random number generator
 func seed() {
 	randint, _ := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
@@ -41,8 +51,9 @@ func origin() string {
 	return "ws://" + name
 }
 
-// New creates a new producer that sends messages to broker that lives
-// at the given hostport.
+// New creates a new producer that sends messages to the leaders of the
+// partitions, as found by the register or broker at the given hostport. A
+// comma-separated list of the registers in a register cluster may be given.
 func New(hostport string, id *string) *Producer {
 
 	if nil == id {
@@ -51,51 +62,176 @@ func New(hostport string, id *string) *Producer {
 		id = &idStr
 	}
 
+	// sequence numbers start from the time, so that a restarted producer with
+	// the same ID does not reuse them and have its messages dropped
+	return &Producer{
+		id:          *id,
+		seqnum:      time.Now().UnixNano(),
+		sockets:     make(map[string]*protocol.Socket),
+		registers:   protocol.Registers(hostport),
+		partitions:  1,
+		partitioner: HashPartitioner,
+	}
+
+}
+
+// socket returns the socket to the leader of the given partition. Each
+// partition may be led by a different broker, so each has its own socket.
+// Caller must hold the producer lock.
+func (p *Producer) socket(partition string) *protocol.Socket {
+
+	if socket, exists := p.sockets[partition]; exists {
+		return socket
+	}
+
 	socket := &protocol.Socket{
-		HostPort: hostport,
-		Path:     protocol.PUBLISH,
-		Origin:   origin(),
+		HostPort:  p.registers[0],
+		Path:      protocol.PUBLISH,
+		Origin:    origin(),
+		Registers: p.registers,
 	}
 
-	return &Producer{id: *id, socket: socket, register: hostport}
+	p.sockets[partition] = socket
+	return socket
+
+}
 
+// SetPartitioner configures the number of partitions of each topic, and the
+// partitioner used to choose among them. This must match the number of
+// partitions configured on the brokers.
+func (p *Producer) SetPartitioner(partitions int, partitioner Partitioner) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.partitions = partitions
+	p.partitioner = partitioner
 }
 
 // Send sends the message to the broker, and blocks until an acknowledgement is
-// received. If the max number of retries is exceeded, returns the last error.
-func (p *Producer) Send(topic string, payload []byte) error {
+// received. Returns the position at which the message was written. If the max
+// number of retries is exceeded, returns the last error.
+func (p *Producer) Send(topic string, payload []byte) (*protocol.Position, error) {
+	return p.SendKey(topic, nil, payload)
+}
 
-	seqnum := atomic.AddInt64(&p.seqnum, 1)
-	message := protocol.Message{seqnum, payload, crc32.ChecksumIEEE(payload)}
-	request := &protocol.ProduceRequest{p.id, topic, message}
+// SendKey sends the message to the partition of the topic chosen by the
+// producer's partitioner for the given key, and blocks until an
+// acknowledgement is received. Messages with the same key are delivered in
+// order if the partitioner maps them to the same partition. Sends are made one
+// at a time, so sequence numbers reach brokers in the order they are taken.
+func (p *Producer) SendKey(topic string, key []byte, payload []byte) (*protocol.Position, error) {
 
-	log.Debug("Sending %v", request)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.explicit {
+		return nil, MIXED_IDS
+	}
+
+	partition := p.partitioner(key, p.partitions)
+	p.seqnum++
+	message := protocol.Message{p.seqnum, payload, crc32.ChecksumIEEE(payload), nil}
+	return p.send(topic, partition, message)
+
+}
+
+// SendID sends the message with the given ID, instead of the next sequence
+// number, and the given headers to the given partition of the topic, and
+// blocks until an acknowledgement is received. Brokers drop a message from
+// this producer with an ID no higher than that of the last message written to
+// the partition, even after they restart or another broker takes over, so IDs
+// must increase, and resending a message after a failure does not duplicate
+// it. A producer that uses SendID cannot use other sends, and vice versa.
+func (p *Producer) SendID(topic string, partition int, id int64, headers map[string]string, payload []byte) (*protocol.Position, error) {
 
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	if p.sent && !p.explicit {
+		return nil, MIXED_IDS
+	}
+
+	p.explicit = true
+	message := protocol.Message{id, payload, crc32.ChecksumIEEE(payload), headers}
+	return p.send(topic, partition, message)
+
+}
+
+// send sends the message to the leader of the partition, and retries until an
+// acknowledgement is received, or the message is refused, e.g. because the
+// topic is invalid. Returns the position from the receipt. Caller must hold
+// the producer lock.
+func (p *Producer) send(topic string, partition int, message protocol.Message) (*protocol.Position, error) {
+
+	request := &protocol.ProduceRequest{p.id, topic, partition, message, nil}
+
+	log.Debug("Sending %v", request)
+	p.sent = true
+
+	socket := p.socket(protocol.PartitionName(topic, partition))
 	for {
 
-		if _, err := p.socket.Send(request, MAX_RETRIES, origin()); nil != err {
-			p.socket.Reset(p.register)
+		payload, err := socket.Send(request, MAX_RETRIES, origin())
+		switch err {
+		case nil:
+		case protocol.REFUSED:
+			return nil, err
+		default:
+			socket.Reset(p.registers[0])
 			continue
 		}
 
 		log.Debug("Acknowledgement received.")
-		return nil
+
+		receipt := new(protocol.ProduceReceipt)
+		if err := json.Unmarshal(payload, receipt); nil != err {
+			return nil, err
+		}
+
+		if 1 != len(receipt.Offsets) {
+			return nil, fmt.Errorf("Expected 1 offset, was %d.", len(receipt.Offsets))
+		}
+
+		return &protocol.Position{receipt.Topic, receipt.Partition, receipt.Offsets[0]}, nil
 
 	}
 
-	return nil
+}
+
+// Metadata asks the register for the brokers of the cluster, and the leader,
+// in-sync followers and tail of every partition of the given topics, or of all
+// topics if none are given.
+func (p *Producer) Metadata(topics ...string) (*protocol.Metadata, error) {
+
+	socket := &protocol.Socket{
+		HostPort:  p.registers[0],
+		Path:      protocol.METADATA,
+		Origin:    origin(),
+		Registers: p.registers,
+	}
+	defer socket.Close()
+
+	payload, err := socket.Send(&protocol.MetadataRequest{topics}, MAX_RETRIES, origin())
+	if nil != err {
+		return nil, err
+	}
+
+	metadata := new(protocol.Metadata)
+	if err := json.Unmarshal(payload, metadata); nil != err {
+		return nil, err
+	}
+
+	return metadata, nil
 
 }
 
-// Close closes the producer's websocket connection. Must not be invoked while
+// Close closes the producer's websocket connections. Must not be invoked while
 // there are still Sends pending.
 func (p *Producer) Close() {
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	p.socket.Close()
+	for _, socket := range p.sockets {
+		socket.Close()
+	}
 }
 
 // ProduceErrors indicate that a produce request failed.
@@ -2,6 +2,7 @@ package producer
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"encoding/json"
 	"net"
 	"net/http"
 	"octopi/api/protocol"
@@ -25,9 +26,12 @@ func accept(ref *ptr) func(*websocket.Conn) {
 				return
 			}
 			lock.Lock()
+			offset := int64(len(ref.messages))
 			ref.messages = append(ref.messages, &msg.Message)
 			lock.Unlock()
-			ack := &protocol.Ack{protocol.StatusSuccess, nil}
+			receipt := &protocol.ProduceReceipt{msg.Topic, msg.Partition, []int64{offset}}
+			payload, _ := json.Marshal(receipt)
+			ack := &protocol.Ack{Status: protocol.StatusSuccess, Payload: payload}
 			if err := websocket.JSON.Send(conn, ack); nil != err {
 				return
 			}
@@ -35,7 +39,8 @@ func accept(ref *ptr) func(*websocket.Conn) {
 	}
 }
 
-// TestBroker ensures that producer sends messages to the broker.
+// TestBroker ensures that producer sends messages to the broker, and returns
+// the position of each message.
 func TestBroker(tester *testing.T) {
 
 	t := test.New(tester)
@@ -52,8 +57,10 @@ func TestBroker(tester *testing.T) {
 
 	producer := New("localhost:11111", nil)
 	for i := 0; i < 10; i++ {
-		err = producer.Send("x", []byte(strconv.Itoa(i)))
+		position, err := producer.Send("x", []byte(strconv.Itoa(i)))
 		t.AssertNil(err, "producer.Send")
+		t.AssertEqual(new(test.StringMatcher), "x", position.Topic)
+		t.AssertEqual(new(test.IntMatcher), i, int(position.Offset))
 	}
 
 	listener.Close()
@@ -100,3 +107,228 @@ func TestRetries(tester *testing.T) {
 	}
 
 }
+
+// TestHashPartitioner ensures that messages with the same key are sent to the
+// same partition.
+func TestHashPartitioner(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+
+	for i := 0; i < 10; i++ {
+		key := []byte(strconv.Itoa(i))
+		partition := HashPartitioner(key, 4)
+		t.AssertTrue(partition >= 0 && partition < 4, "HashPartitioner")
+		t.AssertEqual(matcher, partition, HashPartitioner(key, 4))
+	}
+
+}
+
+// TestKeylessPartitioner ensures that messages sent without a key are spread
+// across partitions by the default partitioner.
+func TestKeylessPartitioner(tester *testing.T) {
+
+	t := test.New(tester)
+	seen := make(map[int]bool)
+
+	for i := 0; i < 4; i++ {
+		partition := HashPartitioner(nil, 4)
+		t.AssertTrue(partition >= 0 && partition < 4, "HashPartitioner")
+		seen[partition] = true
+	}
+
+	t.AssertEqual(new(test.IntMatcher), 4, len(seen))
+
+}
+
+// TestRoundRobinPartitioner ensures that messages are spread evenly across
+// partitions.
+func TestRoundRobinPartitioner(tester *testing.T) {
+
+	t := test.New(tester)
+	partitioner := RoundRobinPartitioner()
+
+	for i := 0; i < 10; i++ {
+		t.AssertEqual(new(test.IntMatcher), i%3, partitioner([]byte("x"), 3))
+	}
+
+}
+
+// batches records the sizes of the batches that it receives, and assigns each
+// message the next offset.
+func batches(sizes *[]int) func(*websocket.Conn) {
+	lock := new(sync.Mutex)
+	offset := int64(0)
+	return func(conn *websocket.Conn) {
+		for {
+			var request protocol.ProduceRequest
+			if err := websocket.JSON.Receive(conn, &request); nil != err {
+				return
+			}
+			lock.Lock()
+			*sizes = append(*sizes, len(request.Messages))
+			receipt := &protocol.ProduceReceipt{request.Topic, request.Partition, nil}
+			for _ = range request.Messages {
+				receipt.Offsets = append(receipt.Offsets, offset)
+				offset++
+			}
+			lock.Unlock()
+			payload, _ := json.Marshal(receipt)
+			ack := &protocol.Ack{Status: protocol.StatusSuccess, Payload: payload}
+			if err := websocket.JSON.Send(conn, ack); nil != err {
+				return
+			}
+		}
+	}
+}
+
+// TestAsync ensures that asynchronous producers send messages in batches, and
+// resolve each future with the offset of its message.
+func TestAsync(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+
+	listener, err := net.Listen("tcp", ":11112")
+	t.AssertNil(err, "net.Listen")
+	defer listener.Close()
+
+	sizes := make([]int, 0)
+	go http.Serve(listener, websocket.Handler(batches(&sizes)))
+
+	options := AsyncOptions{BatchSize: 4, Linger: 50 * time.Millisecond}
+	producer := NewAsync("localhost:11112", nil, options)
+
+	futures := make([]*Future, 0)
+	for i := 0; i < 10; i++ {
+		future, err := producer.Send("x", []byte(strconv.Itoa(i)))
+		t.AssertNil(err, "producer.Send")
+		futures = append(futures, future)
+	}
+
+	for i, future := range futures {
+		position, err := future.Wait()
+		t.AssertNil(err, "future.Wait")
+		t.AssertEqual(new(test.StringMatcher), "x", position.Topic)
+		t.AssertEqual(matcher, i, int(position.Offset))
+	}
+
+	producer.Close()
+	_, err = producer.Send("x", []byte("y"))
+	t.AssertTrue(CLOSED == err, "producer.Send")
+
+	t.AssertEqual(matcher, 3, len(sizes))
+	t.AssertEqual(matcher, 4, sizes[0])
+	t.AssertEqual(matcher, 2, sizes[2])
+
+}
+
+// TestAsyncBufferFull ensures that asynchronous producers configured to fail
+// refuse messages while their buffer is full.
+func TestAsyncBufferFull(tester *testing.T) {
+
+	t := test.New(tester)
+
+	listener, err := net.Listen("tcp", ":11113")
+	t.AssertNil(err, "net.Listen")
+	defer listener.Close()
+
+	sizes := make([]int, 0)
+	go http.Serve(listener, websocket.Handler(batches(&sizes)))
+
+	options := AsyncOptions{Linger: 100 * time.Millisecond, Buffer: 4, Fail: true}
+	producer := NewAsync("localhost:11113", nil, options)
+	defer producer.Close()
+
+	future, err := producer.Send("x", []byte("abc"))
+	t.AssertNil(err, "producer.Send")
+	_, err = producer.Send("x", []byte("def"))
+	t.AssertTrue(BUFFER_FULL == err, "producer.Send")
+
+	_, err = future.Wait()
+	t.AssertNil(err, "future.Wait")
+	_, err = producer.Send("x", []byte("def"))
+	t.AssertNil(err, "producer.Send")
+
+}
+
+// sequence records the IDs of the messages of each topic that it receives, in
+// order of arrival, and assigns each message the next offset.
+func sequence(ids map[string][]int64, lock *sync.Mutex) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		for {
+			var request protocol.ProduceRequest
+			if err := websocket.JSON.Receive(conn, &request); nil != err {
+				return
+			}
+			messages := request.Messages
+			if 0 == len(messages) {
+				messages = []protocol.Message{request.Message}
+			}
+			lock.Lock()
+			receipt := &protocol.ProduceReceipt{request.Topic, request.Partition, nil}
+			for _, message := range messages {
+				receipt.Offsets = append(receipt.Offsets, int64(len(ids[request.Topic])))
+				ids[request.Topic] = append(ids[request.Topic], message.ID)
+			}
+			lock.Unlock()
+			payload, _ := json.Marshal(receipt)
+			ack := &protocol.Ack{Status: protocol.StatusSuccess, Payload: payload}
+			if err := websocket.JSON.Send(conn, ack); nil != err {
+				return
+			}
+		}
+	}
+}
+
+// TestConcurrentSends ensures that messages sent concurrently on one producer
+// reach the broker in the order of their sequence numbers, so that none is
+// mistaken for a resend, and that SendID cannot be mixed with other sends.
+func TestConcurrentSends(tester *testing.T) {
+
+	t := test.New(tester)
+
+	listener, err := net.Listen("tcp", ":11116")
+	t.AssertNil(err, "net.Listen")
+	defer listener.Close()
+
+	ids := make(map[string][]int64)
+	lock := new(sync.Mutex)
+	go http.Serve(listener, websocket.Handler(sequence(ids, lock)))
+
+	producer := New("localhost:11116", nil)
+	async := NewAsync("localhost:11116", nil, AsyncOptions{BatchSize: 3})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := producer.Send("x", []byte("x"))
+			t.AssertNil(err, "producer.Send")
+		}()
+		go func() {
+			defer wg.Done()
+			future, err := async.Send("y", []byte("y"))
+			t.AssertNil(err, "async.Send")
+			_, err = future.Wait()
+			t.AssertNil(err, "future.Wait")
+		}()
+	}
+	wg.Wait()
+	async.Close()
+
+	// the IDs of each producer increase in order of arrival
+	lock.Lock()
+	defer lock.Unlock()
+	for _, topic := range []string{"x", "y"} {
+		t.AssertEqual(new(test.IntMatcher), 20, len(ids[topic]))
+		for i := 1; i < len(ids[topic]); i++ {
+			t.AssertTrue(ids[topic][i] > ids[topic][i-1], "ID order")
+		}
+	}
+
+	_, err = producer.SendID("x", 0, 1, nil, []byte("x"))
+	t.AssertTrue(MIXED_IDS == err, "producer.SendID")
+
+}
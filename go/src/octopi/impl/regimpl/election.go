@@ -0,0 +1,160 @@
+package regimpl
+
+import (
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"sort"
+	"time"
+)
+
+// Number of failed rounds in a row after which an election is stuck.
+const STUCK_ROUNDS = 3
+
+// Rounds describe the latest round of an election of a leader of a partition
+// that is in progress.
+type Round struct {
+	Generation int64     // generation of the round
+	Started    time.Time // time at which the round started
+	Failures   int       // number of rounds in a row that failed
+	Problem    string    // why the last round failed, if it did
+	Stuck      bool      // true iff too many rounds in a row failed
+}
+
+// startRound records that a round of election of a leader of the given
+// partition has started. Caller must hold the lock.
+func (r *Register) startRound(partition string, generation int64) {
+	round, exists := r.rounds[partition]
+	if !exists {
+		round = new(Round)
+		r.rounds[partition] = round
+	}
+	round.Generation = generation
+	round.Started = time.Now()
+}
+
+// endRound records the outcome of the latest round of election of a leader of
+// the given partition, and reports the election if it is stuck. A round that
+// was not started because nothing changed counts as failing for the same
+// reason as the last one.
+func (r *Register) endRound(partition string, err error) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	round, exists := r.rounds[partition]
+	if !exists {
+		return
+	}
+
+	if nil == err {
+		delete(r.rounds, partition)
+		return
+	}
+
+	round.Failures++
+	if UNCHANGED != err || "" == round.Problem {
+		round.Problem = err.Error()
+	}
+	round.Stuck = round.Failures >= STUCK_ROUNDS
+
+	if round.Stuck {
+		log.Error("Election of a leader of %s is stuck after %d rounds: %s",
+			partition, round.Failures, round.Problem)
+	} else {
+		log.Warn("Round %d of election of a leader of %s failed: %s",
+			round.Generation, partition, round.Problem)
+	}
+
+}
+
+// keys returns the sorted keys of the given set.
+func keys(set map[string]bool) []string {
+	sorted := make([]string, 0, len(set))
+	for key, _ := range set {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// DataLosses describe unclean elections, in which a broker that was not in
+// sync was elected, so that messages past the end of its log may be lost.
+type DataLoss struct {
+	Partition string           // name of partition
+	Leader    string           // broker elected
+	Tail      int64            // size of the log of the broker elected
+	Truncated map[string]int64 // brokers with longer logs, which are truncated, by tail
+	Time      time.Time        // time of the election
+}
+
+// DataLosses returns the most recent unclean elections, oldest first.
+func (r *Register) DataLosses() []DataLoss {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]DataLoss(nil), r.losses...)
+}
+
+// lost records that the given broker was elected leader of the given partition
+// uncleanly, given the states of the logs of the brokers that were notified.
+func (r *Register) lost(partition string, leader string, states map[string]protocol.LogState) {
+
+	command := &protocol.RegisterCommand{
+		Op:        OP_UNCLEAN,
+		Partition: partition,
+		HostPort:  leader,
+		Tail:      states[leader].Tail,
+		Tails:     make(map[string]int64),
+	}
+
+	for hp, state := range states {
+		if state.Tail > command.Tail {
+			command.Tails[hp] = state.Tail
+		}
+	}
+
+	// the previous leader may not have been reached, but reported its tail
+	r.lock.Lock()
+	previous, reported := r.lastLeader(partition), r.tails[partition]
+	r.lock.Unlock()
+	if previous != EMPTY && reported > command.Tail && reported > command.Tails[previous] {
+		command.Tails[previous] = reported
+	}
+
+	if _, err := r.propose(command); nil != err {
+		log.Warn("Unable to record unclean election of %s: %s", partition, err.Error())
+	}
+
+}
+
+// lastLeader returns the most recent leader of the given partition in the
+// history of transitions. Caller must hold the lock.
+func (r *Register) lastLeader(partition string) string {
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if t := r.history[i]; t.Partition == partition && t.Leader != EMPTY {
+			return t.Leader
+		}
+	}
+	return EMPTY
+}
+
+// lose applies an OP_UNCLEAN command. Caller must hold the lock.
+func (r *Register) lose(command *protocol.RegisterCommand) {
+
+	loss := DataLoss{
+		Partition: command.Partition,
+		Leader:    command.HostPort,
+		Tail:      command.Tail,
+		Truncated: command.Tails,
+		Time:      time.Unix(0, command.Time*int64(time.Millisecond)),
+	}
+
+	log.Error("Unclean election of %s: %v was elected with a log of %d bytes, "+
+		"and the logs of %v are truncated. Messages may be lost!",
+		loss.Partition, loss.Leader, loss.Tail, loss.Truncated)
+
+	r.losses = append(r.losses, loss)
+	if len(r.losses) > HISTORY_SIZE {
+		r.losses = r.losses[len(r.losses)-HISTORY_SIZE:]
+	}
+
+}
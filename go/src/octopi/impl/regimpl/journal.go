@@ -0,0 +1,152 @@
+package regimpl
+
+import (
+	"encoding/json"
+	"io"
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"os"
+)
+
+// Journal file extension.
+const JOURNAL_EXT = ".wal"
+
+// Journals are write-ahead files that hold the Raft state of a register: its
+// term, its vote, its latest snapshot, and its log of register commands since
+// the snapshot. Every change is written and synced before the register acts on
+// it, so that a restarted register neither votes twice in a term nor forgets
+// entries that it acknowledged. Not thread-safe; the Raft lock guards it.
+type Journal struct {
+	name    string        // path of journal file
+	file    *os.File      // journal file
+	encoder *json.Encoder // encoder for records
+}
+
+// Records are the entries of a journal. Each record holds the term and vote,
+// and replaces the entries of the log from Index onwards, if Index is set. A
+// record with a snapshot replaces the whole log.
+type Record struct {
+	Term      int64                    // current term
+	VotedFor  string                   // candidate voted for in term
+	Index     int64                    // index of first entry, if any
+	Entries   []protocol.RegisterEntry // entries from index
+	SnapIndex int64                    // index of the last entry in the snapshot
+	SnapTerm  int64                    // term of the last entry in the snapshot
+	Snapshot  []byte                   // register state as of SnapIndex, if any
+}
+
+// OpenJournal opens the journal at the given path, and returns the term, vote,
+// snapshot and log that it holds. The journal is compacted into a single
+// record, which also discards a record that was torn by a crash.
+func OpenJournal(name string) (*Journal, *Record, error) {
+
+	state := new(Record)
+
+	file, err := os.Open(name)
+	switch {
+	case nil == err:
+		replay(file, state)
+		file.Close()
+	case !os.IsNotExist(err):
+		return nil, nil, err
+	}
+
+	j := &Journal{name: name}
+	state.Index = state.SnapIndex + 1
+	if err := j.Rewrite(state); nil != err {
+		return nil, nil, err
+	}
+
+	log.Info("Loaded %d entries after index %d from %s in term %d.",
+		len(state.Entries), state.SnapIndex, name, state.Term)
+	return j, state, nil
+
+}
+
+// Rewrite replaces the journal with the given record, which must hold the
+// whole state of the register. The new journal is written to a temporary file
+// and renamed over the old one, so a crash leaves one or the other.
+func (j *Journal) Rewrite(state *Record) error {
+
+	temp := j.name + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if nil != err {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	if err := encoder.Encode(state); nil != err {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); nil != err {
+		file.Close()
+		return err
+	}
+
+	if err := os.Rename(temp, j.name); nil != err {
+		file.Close()
+		return err
+	}
+
+	if nil != j.file {
+		j.file.Close()
+	}
+
+	j.file = file
+	j.encoder = encoder
+	return nil
+
+}
+
+// replay applies the records read from the given reader to the given state.
+// Reading stops at the first record that cannot be decoded.
+func replay(reader io.Reader, state *Record) {
+
+	decoder := json.NewDecoder(reader)
+
+	for {
+
+		var next Record
+		if err := decoder.Decode(&next); nil != err {
+			if io.EOF != err {
+				log.Warn("Ignoring torn journal record: %s", err.Error())
+			}
+			return
+		}
+
+		state.Term = next.Term
+		state.VotedFor = next.VotedFor
+		if nil != next.Snapshot {
+			state.SnapIndex = next.SnapIndex
+			state.SnapTerm = next.SnapTerm
+			state.Snapshot = next.Snapshot
+			state.Entries = nil
+		}
+
+		// position of the first entry in the entries after the snapshot
+		first := next.Index - state.SnapIndex
+		if next.Index > 0 && first >= 1 && first <= int64(len(state.Entries))+1 {
+			state.Entries = append(state.Entries[0:first-1], next.Entries...)
+		}
+
+	}
+
+}
+
+// Write appends the given record to the journal, and syncs it to disk.
+func (j *Journal) Write(r *Record) error {
+
+	if err := j.encoder.Encode(r); nil != err {
+		return err
+	}
+
+	return j.file.Sync()
+
+}
+
+// Close closes the journal.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,78 @@
+package regimpl
+
+import (
+	"octopi/api/protocol"
+	"sort"
+)
+
+// ReportTail records the size of the log of the given partition, as reported
+// by its leader in a heartbeat.
+func (r *Register) ReportTail(partition string, tail int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tails[partition] = tail
+}
+
+// Metadata returns the live brokers, and the leader, leader epoch, in-sync
+// followers and tail of every partition of the given topics, or of all topics
+// if none are given. Only the leading register knows which brokers are live
+// and the tails of partitions.
+func (r *Register) Metadata(topics []string) *protocol.Metadata {
+
+	wanted := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		wanted[topic] = true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	metadata := &protocol.Metadata{
+		Brokers:    make([]protocol.HostPort, 0, len(r.live)),
+		Partitions: make([]protocol.PartitionMetadata, 0),
+	}
+
+	for hp, _ := range r.live {
+		metadata.Brokers = append(metadata.Brokers, protocol.HostPort(hp))
+	}
+	sort.Sort(hostPorts(metadata.Brokers))
+
+	names := make([]string, 0, len(r.leaders))
+	for name, _ := range r.leaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		topic, partition := protocol.ParsePartition(name)
+		if 0 != len(wanted) && !wanted[topic] {
+			continue
+		}
+
+		p := protocol.PartitionMetadata{
+			Topic:     topic,
+			Partition: partition,
+			Leader:    protocol.HostPort(r.leaders[name]),
+			Epoch:     r.epochs[name],
+			Insync:    make([]protocol.HostPort, 0, len(r.insync[name])),
+			Tail:      r.tails[name],
+		}
+		for hp, _ := range r.insync[name] {
+			p.Insync = append(p.Insync, protocol.HostPort(hp))
+		}
+		sort.Sort(hostPorts(p.Insync))
+		metadata.Partitions = append(metadata.Partitions, p)
+
+	}
+
+	return metadata
+
+}
+
+// hostPorts sorts host:ports.
+type hostPorts []protocol.HostPort
+
+func (h hostPorts) Len() int           { return len(h) }
+func (h hostPorts) Less(i, j int) bool { return h[i] < h[j] }
+func (h hostPorts) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
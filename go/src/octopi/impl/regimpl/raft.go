@@ -0,0 +1,703 @@
+package regimpl
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"errors"
+	"math/rand"
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"sync"
+	"time"
+)
+
+// Roles of a register in the register cluster.
+const (
+	RAFT_FOLLOWER = iota
+	RAFT_CANDIDATE
+	RAFT_LEADER
+)
+
+const (
+	// time in ms between heartbeats from the leading register
+	HEARTBEAT_INTERVAL = 100
+	// minimum time in ms without heartbeats before a register stands for
+	// election; the actual timeout is randomized up to twice this
+	ELECTION_TIMEOUT = 1000
+	// time in ms to wait for a proposed change to be committed
+	PROPOSE_TIMEOUT = 5000
+	// time in ms to wait for a reply from another register
+	RPC_TIMEOUT = 500
+	// number of applied entries after which the log is compacted into a
+	// snapshot
+	SNAPSHOT_THRESHOLD = 1000
+)
+
+// NOT_LEADING is the error returned when a change is proposed to a register
+// that does not lead the register cluster.
+var NOT_LEADING = errors.New("Register does not lead the register cluster.")
+
+// Raft replicates a log of register commands across the register cluster using
+// the Raft consensus protocol. Committed commands are applied in order by
+// every register. With no peers, a register commits its own commands. Once
+// enough entries have been applied, they are replaced by a snapshot of the
+// register state, which is sent to peers that fall behind it.
+type Raft struct {
+	id        string                                      // host:port of this register
+	peers     []string                                    // host:port of the other registers
+	role      int                                         // follower, candidate or leader
+	term      int64                                       // current term
+	votedFor  string                                      // candidate voted for in this term
+	votes     int                                         // votes received as candidate
+	leader    string                                      // leader of the current term, if known
+	entries   []protocol.RegisterEntry                    // log; entry i has index snapIndex+i+1
+	snapIndex int64                                       // index of the last entry in the snapshot
+	snapTerm  int64                                       // term of the last entry in the snapshot
+	state     []byte                                      // snapshot of the register state, if any
+	threshold int64                                       // applied entries to keep before compacting
+	commit    int64                                       // index of last committed entry
+	applied   int64                                       // index of last applied entry
+	next      map[string]int64                            // index of next entry for each peer
+	match     map[string]int64                            // index of last matching entry for each peer
+	inflight  map[string]bool                             // peers with an append in flight
+	waiting   map[int64]chan interface{}                  // proposals waiting to be applied
+	contact   time.Time                                   // last time the leader was heard from
+	timeout   time.Duration                               // election timeout
+	apply     func(*protocol.RegisterCommand) interface{} // applies commands
+	leading   func(bool)                                  // invoked when leadership changes
+	save      func() []byte                               // snapshots the register state
+	restore   func([]byte)                                // replaces the register state
+	journal   *Journal                                    // durable state, if any
+	lock      sync.Mutex                                  // lock
+}
+
+// NewRaft creates a new member of the register cluster. The given function is
+// used to apply committed commands, and leading is invoked with true whenever
+// this register becomes the leader, and with false when it stops leading. Save
+// returns a snapshot of the state built by the commands applied so far, and
+// restore replaces the state with a snapshot. The term, vote, snapshot and log
+// are recovered from the journal at the given path, and kept in memory only if
+// the path is EMPTY.
+func NewRaft(id string, peers []string, journal string,
+	apply func(*protocol.RegisterCommand) interface{}, leading func(bool),
+	save func() []byte, restore func([]byte)) (*Raft, error) {
+
+	r := &Raft{
+		id:        id,
+		peers:     peers,
+		role:      RAFT_FOLLOWER,
+		next:      make(map[string]int64),
+		match:     make(map[string]int64),
+		inflight:  make(map[string]bool),
+		waiting:   make(map[int64]chan interface{}),
+		contact:   time.Now(),
+		timeout:   electionTimeout(),
+		apply:     apply,
+		leading:   leading,
+		save:      save,
+		restore:   restore,
+		threshold: SNAPSHOT_THRESHOLD,
+	}
+
+	if EMPTY == journal {
+		return r, nil
+	}
+
+	j, state, err := OpenJournal(journal)
+	if nil != err {
+		return nil, err
+	}
+
+	// entries are applied again once the commit index is learned
+	r.journal = j
+	r.term = state.Term
+	r.votedFor = state.VotedFor
+	r.entries = state.Entries
+	r.snapIndex = state.SnapIndex
+	r.snapTerm = state.SnapTerm
+	r.state = state.Snapshot
+
+	// the snapshot only holds committed entries
+	if nil != r.state {
+		r.restore(r.state)
+		r.commit = r.snapIndex
+		r.applied = r.snapIndex
+	}
+
+	return r, nil
+
+}
+
+// electionTimeout returns a random election timeout, so that registers rarely
+// stand for election at the same time.
+func electionTimeout() time.Duration {
+	ms := ELECTION_TIMEOUT + rand.Intn(ELECTION_TIMEOUT)
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Start starts sending heartbeats and standing for elections. A register
+// without peers leads immediately.
+func (r *Raft) Start() {
+	if 0 == len(r.peers) {
+		r.lock.Lock()
+		r.stand()
+		r.lock.Unlock()
+	}
+	go r.run()
+}
+
+// run sends heartbeats while leading, and stands for election when the leader
+// has not been heard from for too long.
+func (r *Raft) run() {
+	for _ = range time.Tick(HEARTBEAT_INTERVAL * time.Millisecond) {
+		r.lock.Lock()
+		switch r.role {
+		case RAFT_LEADER:
+			r.broadcast()
+		default:
+			if time.Since(r.contact) > r.timeout {
+				r.stand()
+			}
+		}
+		r.lock.Unlock()
+	}
+}
+
+// IsLeader returns true iff this register leads the register cluster.
+func (r *Raft) IsLeader() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return RAFT_LEADER == r.role
+}
+
+// Leader returns the host:port of the leader of the register cluster, or EMPTY
+// if it is not known.
+func (r *Raft) Leader() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.leader
+}
+
+// Propose appends the given command to the log, and blocks until it has been
+// committed and applied. Returns the result of applying the command, or
+// NOT_LEADING if this register does not lead the cluster.
+func (r *Raft) Propose(command *protocol.RegisterCommand) (interface{}, error) {
+
+	r.lock.Lock()
+
+	if RAFT_LEADER != r.role {
+		r.lock.Unlock()
+		return nil, NOT_LEADING
+	}
+
+	r.entries = append(r.entries, protocol.RegisterEntry{r.term, *command})
+	index := r.lastIndex()
+	r.persist(index)
+	done := make(chan interface{}, 1)
+	r.waiting[index] = done
+
+	r.advance()
+	r.broadcast()
+	r.lock.Unlock()
+
+	select {
+	case result, ok := <-done:
+		if !ok {
+			return nil, NOT_LEADING
+		}
+		return result, nil
+	case <-time.After(PROPOSE_TIMEOUT * time.Millisecond):
+		return nil, NOT_LEADING
+	}
+
+}
+
+// stand starts an election for a new term, voting for itself. Caller must
+// hold the lock.
+func (r *Raft) stand() {
+
+	r.term++
+	r.role = RAFT_CANDIDATE
+	r.votedFor = r.id
+	r.votes = 1
+	r.leader = EMPTY
+	r.persist(0)
+	r.contact = time.Now()
+	r.timeout = electionTimeout()
+
+	log.Info("Standing for election in term %d.", r.term)
+
+	request := &protocol.VoteRequest{r.term, r.id, r.lastIndex(), r.lastTerm()}
+	for _, peer := range r.peers {
+		go r.requestVote(peer, request)
+	}
+
+	r.tally()
+
+}
+
+// requestVote asks the given peer for its vote.
+func (r *Raft) requestVote(peer string, request *protocol.VoteRequest) {
+
+	var reply protocol.VoteReply
+	if err := call(peer, protocol.VOTE, request, &reply); nil != err {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+
+	if RAFT_CANDIDATE != r.role || request.Term != r.term || !reply.Granted {
+		return
+	}
+
+	r.votes++
+	r.tally()
+
+}
+
+// tally becomes the leader if a majority has voted for this register. Caller
+// must hold the lock.
+func (r *Raft) tally() {
+
+	if RAFT_CANDIDATE != r.role || r.votes <= (len(r.peers)+1)/2 {
+		return
+	}
+
+	r.role = RAFT_LEADER
+	r.leader = r.id
+	for _, peer := range r.peers {
+		r.next[peer] = r.lastIndex() + 1
+		r.match[peer] = 0
+	}
+
+	log.Info("Leading the register cluster in term %d.", r.term)
+
+	// commit an entry in this term, so that earlier entries are committed too
+	r.entries = append(r.entries, protocol.RegisterEntry{Term: r.term})
+	r.persist(r.lastIndex())
+	r.advance()
+	r.broadcast()
+
+	go r.leading(true)
+
+}
+
+// stepDown becomes a follower in the given term. Pending proposals are failed,
+// since they may never be committed. Caller must hold the lock.
+func (r *Raft) stepDown(term int64) {
+
+	if term > r.term {
+		r.term = term
+		r.votedFor = EMPTY
+		r.leader = EMPTY
+		r.persist(0)
+	}
+
+	if RAFT_LEADER == r.role {
+		log.Info("Stepping down as leader of the register cluster.")
+		go r.leading(false)
+	}
+
+	r.role = RAFT_FOLLOWER
+	r.contact = time.Now()
+	for index, done := range r.waiting {
+		close(done)
+		delete(r.waiting, index)
+	}
+
+}
+
+// broadcast sends new entries, or heartbeats, to all peers. Caller must hold
+// the lock.
+func (r *Raft) broadcast() {
+	for _, peer := range r.peers {
+		if !r.inflight[peer] {
+			r.inflight[peer] = true
+			go r.replicate(peer)
+		}
+	}
+}
+
+// replicate sends the entries that the given peer is missing, or the snapshot
+// if some of them have been compacted.
+func (r *Raft) replicate(peer string) {
+
+	r.lock.Lock()
+	prev := r.next[peer] - 1
+	if prev < r.snapIndex {
+		r.lock.Unlock()
+		r.sendSnapshot(peer)
+		return
+	}
+
+	request := &protocol.AppendRequest{
+		Term:      r.term,
+		Leader:    r.id,
+		PrevIndex: prev,
+		PrevTerm:  r.termAt(prev),
+		Entries:   append([]protocol.RegisterEntry(nil), r.entries[prev-r.snapIndex:]...),
+		Commit:    r.commit,
+	}
+	r.lock.Unlock()
+
+	var reply protocol.AppendReply
+	err := call(peer, protocol.APPEND, request, &reply)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.inflight[peer] = false
+
+	if nil != err || RAFT_LEADER != r.role || request.Term != r.term {
+		return
+	}
+
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+
+	if reply.Success {
+		r.match[peer] = reply.Index
+		r.next[peer] = reply.Index + 1
+		r.advance()
+	} else if reply.Index+1 < r.next[peer] {
+		r.next[peer] = reply.Index + 1
+	} else if r.next[peer] > 1 {
+		r.next[peer]--
+	}
+
+}
+
+// sendSnapshot sends the snapshot to the given peer.
+func (r *Raft) sendSnapshot(peer string) {
+
+	r.lock.Lock()
+	request := &protocol.SnapshotRequest{
+		Term:     r.term,
+		Leader:   r.id,
+		Index:    r.snapIndex,
+		LastTerm: r.snapTerm,
+		State:    r.state,
+	}
+	r.lock.Unlock()
+
+	var reply protocol.AppendReply
+	err := call(peer, protocol.SNAPSHOT, request, &reply)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.inflight[peer] = false
+
+	if nil != err || RAFT_LEADER != r.role || request.Term != r.term {
+		return
+	}
+
+	if reply.Term > r.term {
+		r.stepDown(reply.Term)
+		return
+	}
+
+	if reply.Success {
+		r.match[peer] = reply.Index
+		r.next[peer] = reply.Index + 1
+		r.advance()
+	}
+
+}
+
+// advance commits the latest entry of the current term that a majority of
+// registers have, along with all entries before it. Caller must hold the lock.
+func (r *Raft) advance() {
+
+	for index := r.lastIndex(); index > r.commit; index-- {
+
+		if r.termAt(index) != r.term {
+			break
+		}
+
+		count := 1
+		for _, peer := range r.peers {
+			if r.match[peer] >= index {
+				count++
+			}
+		}
+
+		if count > (len(r.peers)+1)/2 {
+			r.commit = index
+			break
+		}
+
+	}
+
+	r.applyCommitted()
+
+}
+
+// applyCommitted applies all committed entries that have not been applied yet,
+// and hands the results to waiting proposals. Caller must hold the lock.
+func (r *Raft) applyCommitted() {
+
+	for r.applied < r.commit {
+
+		r.applied++
+		command := &r.entries[r.applied-r.snapIndex-1].Command
+
+		var result interface{}
+		if "" != command.Op {
+			result = r.apply(command)
+		}
+
+		if done, exists := r.waiting[r.applied]; exists {
+			done <- result
+			delete(r.waiting, r.applied)
+		}
+
+	}
+
+	if r.applied-r.snapIndex >= r.threshold {
+		r.compact(r.applied, r.termAt(r.applied), r.save())
+	}
+
+}
+
+// compact replaces the entries up to the given index, which must have been
+// applied, with the given snapshot of the register state as of that index, and
+// rewrites the journal. Entries after the index are kept if the entry at the
+// index has the given term, and discarded otherwise. Caller must hold the
+// lock.
+func (r *Raft) compact(index int64, term int64, state []byte) {
+
+	if index <= r.lastIndex() && r.termAt(index) == term {
+		r.entries = append([]protocol.RegisterEntry(nil), r.entries[index-r.snapIndex:]...)
+	} else {
+		r.entries = nil
+	}
+
+	r.snapIndex = index
+	r.snapTerm = term
+	r.state = state
+
+	if nil == r.journal {
+		return
+	}
+
+	record := &Record{
+		Term:      r.term,
+		VotedFor:  r.votedFor,
+		Index:     r.snapIndex + 1,
+		Entries:   r.entries,
+		SnapIndex: r.snapIndex,
+		SnapTerm:  r.snapTerm,
+		Snapshot:  r.state,
+	}
+
+	if err := r.journal.Rewrite(record); nil != err {
+		log.Panic("Unable to write register journal: %s", err.Error())
+	}
+
+}
+
+// HandleVote handles a vote request from a candidate.
+func (r *Raft) HandleVote(request *protocol.VoteRequest) *protocol.VoteReply {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if request.Term > r.term {
+		r.stepDown(request.Term)
+	}
+
+	reply := &protocol.VoteReply{Term: r.term}
+	if request.Term < r.term {
+		return reply
+	}
+
+	// only vote for candidates whose logs are at least as up-to-date
+	upToDate := request.LastTerm > r.lastTerm() ||
+		(request.LastTerm == r.lastTerm() && request.LastIndex >= r.lastIndex())
+
+	if (EMPTY == r.votedFor || request.Candidate == r.votedFor) && upToDate {
+		r.votedFor = request.Candidate
+		r.persist(0)
+		r.contact = time.Now()
+		reply.Granted = true
+	}
+
+	return reply
+
+}
+
+// HandleAppend handles entries, or a heartbeat, from the leader.
+func (r *Raft) HandleAppend(request *protocol.AppendRequest) *protocol.AppendReply {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reply := &protocol.AppendReply{Term: r.term}
+	if request.Term < r.term {
+		return reply
+	}
+
+	if request.Term > r.term || RAFT_FOLLOWER != r.role {
+		r.stepDown(request.Term)
+	}
+
+	reply.Term = r.term
+	r.leader = request.Leader
+	r.contact = time.Now()
+
+	// entries up to the snapshot are committed, and match the leader's
+	last := request.PrevIndex + int64(len(request.Entries))
+	if request.PrevIndex < r.snapIndex {
+		skip := r.snapIndex - request.PrevIndex
+		if skip > int64(len(request.Entries)) {
+			skip = int64(len(request.Entries))
+		}
+		request.Entries = request.Entries[skip:]
+		request.PrevIndex += skip
+		request.PrevTerm = r.termAt(request.PrevIndex)
+	}
+
+	// reject if the entry before the new ones does not match
+	if request.PrevIndex > r.lastIndex() || r.termAt(request.PrevIndex) != request.PrevTerm {
+		reply.Index = request.PrevIndex - 1
+		if reply.Index > r.lastIndex() {
+			reply.Index = r.lastIndex()
+		}
+		return reply
+	}
+
+	// skip entries that are already in the log, and truncate conflicts
+	for i, entry := range request.Entries {
+		index := request.PrevIndex + int64(i) + 1
+		if index <= r.lastIndex() {
+			if r.termAt(index) == entry.Term {
+				continue
+			}
+			r.entries = r.entries[0 : index-r.snapIndex-1]
+		}
+		r.entries = append(r.entries, request.Entries[i:]...)
+		r.persist(index)
+		break
+	}
+
+	if request.Commit > r.commit {
+		r.commit = request.Commit
+		if last < r.commit {
+			r.commit = last
+		}
+		r.applyCommitted()
+	}
+
+	reply.Success = true
+	reply.Index = last
+	return reply
+
+}
+
+// HandleSnapshot handles a snapshot from the leader, which is sent instead of
+// entries that the leader has compacted.
+func (r *Raft) HandleSnapshot(request *protocol.SnapshotRequest) *protocol.AppendReply {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reply := &protocol.AppendReply{Term: r.term}
+	if request.Term < r.term {
+		return reply
+	}
+
+	if request.Term > r.term || RAFT_FOLLOWER != r.role {
+		r.stepDown(request.Term)
+	}
+
+	reply.Term = r.term
+	r.leader = request.Leader
+	r.contact = time.Now()
+
+	// a snapshot of entries that were already applied is ignored
+	if request.Index > r.applied {
+		r.compact(request.Index, request.LastTerm, request.State)
+		r.restore(request.State)
+		r.applied = request.Index
+		if r.commit < request.Index {
+			r.commit = request.Index
+		}
+		log.Info("Installed snapshot up to index %d.", request.Index)
+	}
+
+	reply.Success = true
+	reply.Index = request.Index
+	return reply
+
+}
+
+// persist writes the term, the vote and the entries from the given index
+// onwards to the journal, before they are acted on. No entries are written if
+// the index is 0. Caller must hold the lock.
+func (r *Raft) persist(index int64) {
+
+	if nil == r.journal {
+		return
+	}
+
+	record := &Record{Term: r.term, VotedFor: r.votedFor}
+	if index > 0 {
+		record.Index = index
+		record.Entries = r.entries[index-r.snapIndex-1:]
+	}
+
+	if err := r.journal.Write(record); nil != err {
+		log.Panic("Unable to write register journal: %s", err.Error())
+	}
+
+}
+
+// lastIndex returns the index of the last entry. Caller must hold the lock.
+func (r *Raft) lastIndex() int64 {
+	return r.snapIndex + int64(len(r.entries))
+}
+
+// lastTerm returns the term of the last entry. Caller must hold the lock.
+func (r *Raft) lastTerm() int64 {
+	return r.termAt(r.lastIndex())
+}
+
+// termAt returns the term of the entry at the given index, or 0 if there is no
+// such entry or it has been compacted. Caller must hold the lock.
+func (r *Raft) termAt(index int64) int64 {
+	switch {
+	case index == r.snapIndex:
+		return r.snapTerm
+	case index < r.snapIndex || index > r.lastIndex():
+		return 0
+	}
+	return r.entries[index-r.snapIndex-1].Term
+}
+
+// call sends the request to the given endpoint of another register, and
+// receives its reply.
+func call(peer string, path string, request interface{}, reply interface{}) error {
+
+	conn, err := websocket.Dial("ws://"+peer+"/"+path, "", "http://"+peer+"/")
+	if nil != err {
+		return err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RPC_TIMEOUT * time.Millisecond))
+
+	if err := websocket.JSON.Send(conn, request); nil != err {
+		return err
+	}
+
+	return websocket.JSON.Receive(conn, reply)
+
+}
@@ -2,8 +2,12 @@ package regimpl
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"errors"
+	"fmt"
+	"io"
 	"octopi/api/protocol"
 	"octopi/util/log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -18,131 +22,928 @@ const (
 	LEADERWAIT = 5000
 )
 
+// Time in ms between checks for brokers to expire.
+const EXPIRY_INTERVAL = 1000
+
+// DECOMMISSIONED is the error returned when a decommissioned broker joins.
+var DECOMMISSIONED = errors.New("Broker has been decommissioned.")
+
+// NO_CANDIDATES is the error returned by rounds of election in which none of
+// the candidates could be reached.
+var NO_CANDIDATES = errors.New("None of the candidates could be reached.")
+
+// UNCHANGED is the error returned instead of starting a round of election that
+// would fail like the last round did.
+var UNCHANGED = errors.New("No candidate or live broker has changed since the last round.")
+
+// Operations of register commands.
+const (
+	OP_PROMOTE    = "promote"    // make a broker the leader of a partition
+	OP_DISCONNECT = "disconnect" // remove the leader of a partition
+	OP_JOIN       = "join"       // record a broker and its partitions
+	OP_ADD        = "add"        // add an in-sync follower
+	OP_REMOVE     = "remove"     // remove an in-sync follower
+	OP_RETIRE     = "retire"     // decommission a broker
+	OP_RESTORE    = "restore"    // allow a decommissioned broker to rejoin
+	OP_EXPIRE     = "expire"     // forget a broker that has not been seen
+	OP_ELECT      = "elect"      // start a round of election of a leader
+	OP_UNCLEAN    = "unclean"    // record data lost in an unclean election
+)
+
+// Registers keep track of the leader, leader epoch and in-sync followers of
+// every partition, and of the brokers that are alive. Registers form a
+// cluster that agrees on this state through Raft; only the leading register
+// serves brokers and clients. Connections held by brokers are local to the
+// leading register, and are closed if it stops leading.
 type Register struct {
-	leader      string
-	insync      map[string]bool
+	leaders     map[string]string          // map of partitions to leaders
+	previous    map[string]string          // map of partitions to last leaders
+	epochs      map[string]int64           // map of partitions to leader epochs
+	insync      map[string]map[string]bool // map of partitions to in-sync sets
+	generations map[string]int64           // map of partitions to election rounds
 	seenBrokers map[string]bool
+	retired     map[string]bool      // decommissioned brokers
+	live        map[string]bool      // brokers that have joined and not left
+	lastSeen    map[string]time.Time // times at which brokers were last live
+	members     map[io.Closer]string // join connections of live brokers
+	connected   map[string]io.Closer // connections of partition leaders
+	elections   map[string]bool      // partitions with an election in progress
+	rounds      map[string]*Round    // latest rounds of elections in progress
+	preferred   map[string]string    // candidates chosen by handoffs, per partition
+	stalled     map[string]string    // brokers of rounds that reached no candidate, per partition
+	reads       map[string]int       // number of consumers redirected per partition
+	tails       map[string]int64     // log sizes reported by partition leaders
+	since       map[string]time.Time // times at which partition leaders were elected
+	history     []Transition         // recent leader transitions, oldest first
+	losses      []DataLoss           // recent unclean elections, oldest first
+	unclean     bool                 // true iff unclean elections are allowed
+	raft        *Raft                // replicates changes across registers
 	lock        sync.Mutex
-	singleton   chan int
 }
 
-// NewRegister returns a new Register object
-func NewRegister() *Register {
-	reg := &Register{
-		insync:      make(map[string]bool),
+// promotions are the results of OP_PROMOTE commands.
+type promotion struct {
+	epoch int64 // leader epoch of the partition
+	ok    bool  // true iff the broker was made leader
+}
+
+// NewRegister returns a new Register with the given host:port, which forms a
+// register cluster with the given peers. With no peers, the register leads
+// itself. State is recovered from and written ahead to the journal at the
+// given path, unless it is EMPTY.
+func NewRegister(id string, peers []string, journal string) (*Register, error) {
+	r := &Register{
+		leaders:     make(map[string]string),
+		previous:    make(map[string]string),
+		epochs:      make(map[string]int64),
+		insync:      make(map[string]map[string]bool),
+		generations: make(map[string]int64),
 		seenBrokers: make(map[string]bool),
-		singleton:   make(chan int, 1),
+		retired:     make(map[string]bool),
+		live:        make(map[string]bool),
+		lastSeen:    make(map[string]time.Time),
+		members:     make(map[io.Closer]string),
+		connected:   make(map[string]io.Closer),
+		elections:   make(map[string]bool),
+		rounds:      make(map[string]*Round),
+		preferred:   make(map[string]string),
+		stalled:     make(map[string]string),
+		reads:       make(map[string]int),
+		tails:       make(map[string]int64),
+		since:       make(map[string]time.Time),
 	}
 
-	reg.singleton <- 1
-	return reg
+	raft, err := NewRaft(id, peers, journal, r.apply, r.leading, r.snapshot, r.restore)
+	if nil != err {
+		return nil, err
+	}
+
+	r.raft = raft
+	r.raft.Start()
+	return r, nil
+}
+
+// IsLeader returns true iff this register leads the register cluster.
+func (r *Register) IsLeader() bool {
+	return r.raft.IsLeader()
+}
+
+// ClusterLeader returns the host:port of the register that leads the register
+// cluster, or EMPTY if it is not known.
+func (r *Register) ClusterLeader() string {
+	return r.raft.Leader()
+}
+
+// Vote handles a vote request from another register.
+func (r *Register) Vote(request *protocol.VoteRequest) *protocol.VoteReply {
+	return r.raft.HandleVote(request)
 }
 
-func (r *Register) Leader() string {
-	return r.leader
+// Append handles entries, or a heartbeat, from the leading register.
+func (r *Register) Append(request *protocol.AppendRequest) *protocol.AppendReply {
+	return r.raft.HandleAppend(request)
 }
 
-// NoLeader returns whether or not the register has a leader or not
-func (r *Register) NoLeader() bool {
-	return r.leader == EMPTY
+// InstallSnapshot handles a snapshot from the leading register.
+func (r *Register) InstallSnapshot(request *protocol.SnapshotRequest) *protocol.AppendReply {
+	return r.raft.HandleSnapshot(request)
 }
 
-func (r *Register) SetLeader(hostport string) {
+// Leader returns the leader of the given partition.
+func (r *Register) Leader(partition string) string {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.leader = hostport
-	r.seenBrokers[hostport] = true
-	log.Info("SetLeader setting leader to be %v", r.leader)
+	return r.leaders[partition]
+}
+
+// NoLeader returns whether or not the given partition has a leader or not
+func (r *Register) NoLeader(partition string) bool {
+	return r.Leader(partition) == EMPTY
 }
 
-// LeaderDisconnect empties out the leader and notifies followers
-// of a change in leader
-func (r *Register) LeaderDisconnect() {
+// Epoch returns the leader epoch issued to the current leader of the given
+// partition.
+func (r *Register) Epoch(partition string) int64 {
 	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.epochs[partition]
+}
 
-	// create a copy to release lock earlier
-	tmpSet := make(map[string]bool)
+// Reader returns the broker that should serve a new subscription to the given
+// partition, cycling through the leader and its live in-sync followers so that
+// reads are spread across them. Returns EMPTY if the partition has no leader.
+func (r *Register) Reader(partition string) string {
 
-	for hp, _ := range r.insync {
-		tmpSet[hp] = true
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	leader := r.leaders[partition]
+	if leader == EMPTY {
+		return EMPTY
 	}
 
-	r.lock.Unlock()
+	followers := make([]string, 0, len(r.insync[partition]))
+	for hp, _ := range r.insync[partition] {
+		if hp != leader && r.live[hp] {
+			followers = append(followers, hp)
+		}
+	}
+
+	// sort so that consecutive consumers go to different brokers
+	sort.Strings(followers)
+	readers := append([]string{leader}, followers...)
+
+	n := r.reads[partition]
+	r.reads[partition]++
+	return readers[n%len(readers)]
+
+}
+
+// Partitions returns the names of all known partitions.
+func (r *Register) Partitions() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	partitions := make([]string, 0, len(r.leaders))
+	for partition, _ := range r.leaders {
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// PromoteLeader makes the given broker the leader of the given partition and
+// issues it a new leader epoch, which is greater than both the previous epoch
+// and the latest epoch seen by the broker. A leader that lost its connection
+// may reclaim leadership with its current epoch. Returns false if the
+// partition already has another leader. The given connection is held by the
+// leader for as long as it leads.
+func (r *Register) PromoteLeader(partition string, hostport string, seen int64, conn io.Closer) (int64, bool, error) {
+
+	command := &protocol.RegisterCommand{
+		Op:        OP_PROMOTE,
+		Partition: partition,
+		HostPort:  hostport,
+		Epoch:     seen,
+	}
+
+	result, err := r.propose(command)
+	if nil != err {
+		return 0, false, err
+	}
 
-	if len(tmpSet) == 0 {
+	promotion := result.(*promotion)
+	if promotion.ok {
 		r.lock.Lock()
-		log.Warn("Set of followers is 0! Notify all seen brokers!!")
-		for hp, _ := range r.seenBrokers {
-			tmpSet[hp] = true
-		}
+		r.connected[partition] = conn
 		r.lock.Unlock()
 	}
 
-	// notify all followers with the same set for consistency
-	// and only remove from original set if fail to contact
-	for hp, _ := range tmpSet {
-		go r.notifyFollower(hp, tmpSet)
+	return promotion.epoch, promotion.ok, nil
+
+}
+
+// LeaderDisconnected empties out the leader of the given partition, if it is
+// still the given broker on the given connection.
+func (r *Register) LeaderDisconnected(partition string, hostport string, conn io.Closer) error {
+
+	r.lock.Lock()
+	current := r.connected[partition] == conn
+	if current {
+		delete(r.connected, partition)
+	}
+	r.lock.Unlock()
+
+	// the leader has reconnected, or this register has stopped leading
+	if !current {
+		return nil
 	}
+
+	_, err := r.propose(&protocol.RegisterCommand{
+		Op:        OP_DISCONNECT,
+		Partition: partition,
+		HostPort:  hostport,
+	})
+	return err
+
 }
 
-// CheckNewLeader allows re-sending of disconnect requests
-// every interval until a leader is connected
-func (r *Register) CheckNewLeader() {
-	select {
-	case <-r.singleton:
-		for r.leader == EMPTY {
-			r.LeaderDisconnect()
-			time.Sleep(LEADERWAIT * time.Millisecond)
-			log.Info("CheckNewLeader leader is ", r.leader)
+// Join marks the given broker as alive for as long as it holds the given
+// connection, and records the partitions that it stores. Returns the names of
+// all known partitions. Partitions without a leader are given one. Returns
+// DECOMMISSIONED if the broker has been decommissioned.
+func (r *Register) Join(hostport string, partitions []string, conn io.Closer) ([]string, error) {
+
+	joined, err := r.propose(&protocol.RegisterCommand{
+		Op:         OP_JOIN,
+		HostPort:   hostport,
+		Partitions: partitions,
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	if !joined.(bool) {
+		return nil, DECOMMISSIONED
+	}
+
+	r.lock.Lock()
+	r.live[hostport] = true
+	r.members[conn] = hostport
+	r.lock.Unlock()
+
+	known := r.Partitions()
+	for _, partition := range known {
+		if r.NoLeader(partition) {
+			go r.CheckNewLeader(partition)
 		}
-		r.singleton <- 1
-	default:
-		// return if an instance already running
 	}
-	log.Info("Returning from CheckNewLeader")
+
+	return known, nil
+
 }
 
-// notifyFollowers notifies the followers of a change in leader
-func (r *Register) notifyFollower(follower string, is map[string]bool) {
-	conn, err := websocket.Dial("ws://"+follower+"/"+protocol.SWAP, "", "http://"+follower+"/")
+// Leave marks the broker holding the given connection as no longer alive.
+func (r *Register) Leave(conn io.Closer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if hostport, exists := r.members[conn]; exists {
+		delete(r.members, conn)
+		delete(r.live, hostport)
+		r.lastSeen[hostport] = time.Now()
+	}
+}
 
-	log.Info("Notifying %v", follower)
+// Decommission removes the given broker from the brokers seen and from every
+// in-sync set, and refuses it if it joins again until it is recommissioned.
+// The broker is disconnected, so that new leaders are elected for the
+// partitions that it leads, and it drains its consumers.
+func (r *Register) Decommission(hostport string) error {
 
-	// failed to contact the follower
+	_, err := r.propose(&protocol.RegisterCommand{
+		Op:       OP_RETIRE,
+		HostPort: hostport,
+	})
 	if nil != err {
-		// remove from follower set
-		r.RemoveFollower(follower)
-		return
+		return err
 	}
 
-	err = websocket.JSON.Send(conn, is)
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-	// failed to send to the follower
-	if nil != err {
-		// remove from follower set
-		r.RemoveFollower(follower)
+	for conn, hp := range r.members {
+		if hp == hostport {
+			conn.Close()
+			delete(r.members, conn)
+		}
+	}
+	delete(r.live, hostport)
+
+	// leaders are disconnected once their leader connections close
+	for partition, conn := range r.connected {
+		if r.leaders[partition] == EMPTY && nil != conn {
+			conn.Close()
+		}
+	}
+
+	log.Info("Decommissioned %v.", hostport)
+	return nil
+
+}
+
+// Recommission allows the given decommissioned broker to join again.
+func (r *Register) Recommission(hostport string) error {
+	_, err := r.propose(&protocol.RegisterCommand{
+		Op:       OP_RESTORE,
+		HostPort: hostport,
+	})
+	return err
+}
+
+// ExpireBrokers periodically forgets brokers that have not been live for the
+// given duration, as if they had been decommissioned, but allows them to join
+// again. Only the leading register expires brokers. Never returns.
+func (r *Register) ExpireBrokers(after time.Duration) {
+	for _ = range time.Tick(EXPIRY_INTERVAL * time.Millisecond) {
+		if r.IsLeader() {
+			r.expire(after)
+		}
+	}
+}
+
+// expire forgets brokers that have not been live for the given duration.
+// Brokers seen before this register started leading are given the full
+// duration to join it.
+func (r *Register) expire(after time.Duration) {
+
+	r.lock.Lock()
+	now := time.Now()
+	expired := make([]string, 0)
+	for hp, _ := range r.seenBrokers {
+		seen, exists := r.lastSeen[hp]
+		switch {
+		case r.live[hp] || !exists:
+			r.lastSeen[hp] = now
+		case now.Sub(seen) > after:
+			log.Info("Expiring %v, which has not been seen since %v.", hp, seen)
+			expired = append(expired, hp)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, hp := range expired {
+		r.propose(&protocol.RegisterCommand{
+			Op:       OP_EXPIRE,
+			HostPort: hp,
+		})
+	}
+
+}
+
+// AddFollower adds a follower to the in-sync followers of the given partition
+func (r *Register) AddFollower(partition string, follower string) error {
+	_, err := r.propose(&protocol.RegisterCommand{
+		Op:        OP_ADD,
+		Partition: partition,
+		HostPort:  follower,
+	})
+	return err
+}
+
+// RemoveFollower removes a follower from the in-sync followers of the given
+// partition
+func (r *Register) RemoveFollower(partition string, follower string) error {
+	_, err := r.propose(&protocol.RegisterCommand{
+		Op:        OP_REMOVE,
+		Partition: partition,
+		HostPort:  follower,
+	})
+	return err
+}
+
+// propose stamps the given command with the current time, and proposes it to
+// the register cluster.
+func (r *Register) propose(command *protocol.RegisterCommand) (interface{}, error) {
+	command.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	return r.raft.Propose(command)
+}
+
+// apply applies a committed command to the state of the register. Commands
+// are applied in the same order on every register.
+func (r *Register) apply(command *protocol.RegisterCommand) interface{} {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	partition, hostport := command.Partition, command.HostPort
+
+	switch command.Op {
+	case OP_PROMOTE:
+		return r.promote(command)
+	case OP_DISCONNECT:
+		if r.leaders[partition] == hostport {
+			r.leaders[partition] = EMPTY
+			r.previous[partition] = hostport
+			r.record(command, EMPTY)
+			log.Info("Leader %v of %s has disconnected", hostport, partition)
+		}
+	case OP_JOIN:
+		if r.retired[hostport] {
+			return false
+		}
+		r.seenBrokers[hostport] = true
+		for _, partition := range command.Partitions {
+			if _, exists := r.leaders[partition]; !exists {
+				r.leaders[partition] = EMPTY
+			}
+		}
+		return true
+	case OP_ADD:
+		if r.retired[hostport] {
+			break
+		}
+		if _, exists := r.insync[partition]; !exists {
+			r.insync[partition] = make(map[string]bool)
+		}
+		r.insync[partition][hostport] = true
+		r.seenBrokers[hostport] = true
+	case OP_REMOVE:
+		delete(r.insync[partition], hostport)
+		if r.previous[partition] == hostport {
+			delete(r.previous, partition)
+		}
+	case OP_RETIRE:
+		r.retired[hostport] = true
+		r.forget(command)
+	case OP_RESTORE:
+		delete(r.retired, hostport)
+	case OP_EXPIRE:
+		r.forget(command)
+	case OP_ELECT:
+		r.generations[partition]++
+		return r.generations[partition]
+	case OP_UNCLEAN:
+		r.lose(command)
+	default:
+		log.Warn("Ignoring unknown register command %s.", command.Op)
+	}
+
+	return nil
+
+}
+
+// forget removes the broker named by the given command from the brokers seen
+// and from every in-sync set, and empties out the leader of the partitions
+// that it leads. Caller must hold the lock.
+func (r *Register) forget(command *protocol.RegisterCommand) {
+
+	hostport := command.HostPort
+	delete(r.seenBrokers, hostport)
+	delete(r.lastSeen, hostport)
+
+	for _, insync := range r.insync {
+		delete(insync, hostport)
+	}
+
+	for partition, leader := range r.leaders {
+		if leader == hostport {
+			r.leaders[partition] = EMPTY
+			disconnect := *command
+			disconnect.Partition = partition
+			r.record(&disconnect, EMPTY)
+		}
+	}
+
+	for partition, leader := range r.previous {
+		if leader == hostport {
+			delete(r.previous, partition)
+		}
+	}
+
+	log.Info("Forgot broker %v.", hostport)
+
+}
+
+// promote applies an OP_PROMOTE command. Caller must hold the lock.
+func (r *Register) promote(command *protocol.RegisterCommand) *promotion {
+
+	partition, hostport, seen := command.Partition, command.HostPort, command.Epoch
+	leader := r.leaders[partition]
+
+	if r.retired[hostport] {
+		return &promotion{r.epochs[partition], false}
+	}
+
+	if leader == hostport && seen == r.epochs[partition] {
+		log.Info("%v reclaimed leadership of %s with epoch %d", hostport, partition, seen)
+		return &promotion{seen, true}
+	}
+
+	if leader != EMPTY {
+		return &promotion{r.epochs[partition], false}
+	}
+
+	if seen > r.epochs[partition] {
+		r.epochs[partition] = seen
+	}
+	r.epochs[partition]++
+	r.leaders[partition] = hostport
+	r.seenBrokers[hostport] = true
+	r.record(command, hostport)
+	log.Info("PromoteLeader setting leader of %s to be %v with epoch %d",
+		partition, hostport, r.epochs[partition])
+	return &promotion{r.epochs[partition], true}
+
+}
+
+// leading is invoked when this register starts or stops leading the register
+// cluster. A new leader gives partition leaders a chance to reconnect before
+// electing new ones. A register that stops leading closes the connections held
+// by brokers, so that they reconnect to the new leader.
+func (r *Register) leading(leading bool) {
+
+	if !leading {
+		r.lock.Lock()
+		for conn, _ := range r.members {
+			conn.Close()
+		}
+		for _, conn := range r.connected {
+			conn.Close()
+		}
+		r.members = make(map[io.Closer]string)
+		r.connected = make(map[string]io.Closer)
+		r.live = make(map[string]bool)
+		r.lastSeen = make(map[string]time.Time)
+		r.tails = make(map[string]int64)
+		r.rounds = make(map[string]*Round)
+		r.stalled = make(map[string]string)
+		r.lock.Unlock()
 		return
 	}
+
+	time.Sleep(LEADERWAIT * time.Millisecond)
+	if !r.IsLeader() {
+		return
+	}
+
+	for _, partition := range r.Partitions() {
+
+		r.lock.Lock()
+		leader := r.leaders[partition]
+		_, connected := r.connected[partition]
+		r.lock.Unlock()
+
+		if leader != EMPTY && !connected {
+			log.Info("Leader %v of %s did not reconnect", leader, partition)
+			r.propose(&protocol.RegisterCommand{
+				Op:        OP_DISCONNECT,
+				Partition: partition,
+				HostPort:  leader,
+			})
+		}
+
+		if r.NoLeader(partition) {
+			go r.CheckNewLeader(partition)
+		}
+
+	}
+
 }
 
-// GetInsyncSet returns the list of in-sync followers
-func (r *Register) GetInsyncSet() map[string]bool {
+// Prefer makes the given in-sync follower the only candidate in the next
+// election of a leader of the given partition. Used by leaders that hand off
+// leadership, which disconnect right after.
+func (r *Register) Prefer(partition string, hostport string) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	return r.insync
+	r.preferred[partition] = hostport
 }
 
-// AddFollower adds a follower to the list of in-sync followers
-func (r *Register) AddFollower(follower string) {
+// SetUncleanElection sets the policy for partitions without an in-sync broker
+// to elect. If allowed, any live broker may be elected, which may lose data.
+// Otherwise, elections wait for an in-sync broker to return.
+func (r *Register) SetUncleanElection(allowed bool) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.insync[follower] = true
-	r.seenBrokers[follower] = true
+	r.unclean = allowed
 }
 
-// RemoveFollower removes a follower from the list of in-sync followers
-func (r *Register) RemoveFollower(follower string) {
+// LeaderDisconnect starts a new round of election of a leader of the given
+// partition: it notifies brokers that the partition needs a new leader, and
+// elects one. Candidates are the in-sync followers and the last leader of the
+// partition, which hold every acknowledged message. If there are none, a new
+// partition is given the live broker that leads the fewest partitions, and
+// other partitions wait unless unclean elections are allowed. A round is only
+// started if it may succeed where the last one failed, i.e. if the candidates,
+// the live brokers or the policy have changed since the last round reached no
+// candidate. Returns an error if no leader was elected, or if it did not
+// acknowledge its election.
+func (r *Register) LeaderDisconnect(partition string) error {
+
+	r.lock.Lock()
+
+	candidates := make(map[string]bool)
+	for hp, _ := range r.insync[partition] {
+		candidates[hp] = true
+	}
+	if hp, exists := r.previous[partition]; exists {
+		candidates[hp] = true
+	}
+
+	// a leader handing off leadership chooses its successor, once
+	hp, preferred := r.preferred[partition]
+	if preferred && candidates[hp] {
+		candidates = map[string]bool{hp: true}
+	}
+
+	unclean := false
+	if len(candidates) == 0 {
+		switch {
+		case 0 == r.epochs[partition]:
+			// a partition that never had a leader has nothing to lose
+			if hp := r.leastLoaded(); hp != EMPTY {
+				candidates[hp] = true
+			}
+		case r.unclean:
+			unclean = true
+			for _, hp := range r.brokers() {
+				candidates[hp] = true
+			}
+		}
+	}
+
+	// notify every live broker, so that they all follow the new leader
+	notify := make(map[string]bool)
+	for hp, _ := range r.live {
+		notify[hp] = true
+	}
+	for hp, _ := range candidates {
+		notify[hp] = true
+	}
+
+	// nothing has changed since the last round that reached no candidate
+	key := fmt.Sprintf("%v %v %v", keys(candidates), keys(notify), r.unclean)
+	if r.stalled[partition] == key {
+		r.lock.Unlock()
+		return UNCHANGED
+	}
+
+	if len(candidates) == 0 {
+		r.stalled[partition] = key
+		r.startRound(partition, r.generations[partition])
+		r.lock.Unlock()
+		return fmt.Errorf("No in-sync broker of %s is left; waiting for one to return.", partition)
+	}
+
+	r.lock.Unlock()
+
+	generation, err := r.propose(&protocol.RegisterCommand{
+		Op:        OP_ELECT,
+		Partition: partition,
+	})
+	if nil != err {
+		return err
+	}
+
+	r.lock.Lock()
+
+	change := &protocol.LeaderChange{
+		Partition:  partition,
+		Candidates: candidates,
+		Generation: generation.(int64),
+	}
+	r.startRound(partition, change.Generation)
+
+	switch {
+	case preferred && candidates[hp]:
+		log.Info("Electing %v as leader of %s, as handed off.", hp, partition)
+	case unclean:
+		log.Warn("No in-sync broker of %s is left! Electing any broker, which may lose data!!", partition)
+	case 0 == r.epochs[partition]:
+		log.Info("Choosing least loaded broker to lead new partition %s.", partition)
+	}
+	delete(r.preferred, partition)
+
+	// without a fallback, unreachable candidates must be waited for
+	evict := r.unclean
+
+	r.lock.Unlock()
+
+	err = r.elect(change, notify, evict, unclean)
+	if nil != err && NO_CANDIDATES == err {
+		r.lock.Lock()
+		r.stalled[partition] = key
+		r.lock.Unlock()
+	}
+
+	return err
+
+}
+
+// elect sends the leader change to every broker to be notified, and collects
+// the state of their logs of the partition. The candidate with the most
+// up-to-date log is elected, and the verdict is sent to every broker, which
+// acknowledge the role that they are about to take. Candidates that cannot be
+// contacted are removed from the in-sync set if evict is set. The data lost by
+// an unclean election is recorded. Returns an error if no leader was elected,
+// or if it did not acknowledge its election.
+func (r *Register) elect(change *protocol.LeaderChange, notify map[string]bool, evict bool, unclean bool) error {
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	conns := make(map[string]*websocket.Conn)
+	states := make(map[string]protocol.LogState)
+
+	for hp, _ := range notify {
+		wg.Add(1)
+		go func(hp string) {
+			defer wg.Done()
+			conn, state, err := r.notifyBroker(hp, change)
+			if nil != err {
+				log.Warn("Unable to notify %v: %s", hp, err.Error())
+				if evict {
+					r.RemoveFollower(change.Partition, hp)
+				}
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			conns[hp] = conn
+			if change.Candidates[hp] {
+				states[hp] = *state
+			}
+		}(hp)
+	}
+
+	wg.Wait()
+
+	verdict := *change
+	verdict.Leader = Elect(states)
+	if verdict.Leader == EMPTY {
+		log.Warn("No candidates for %s could be reached.", change.Partition)
+	} else {
+		log.Info("Elected %v as leader of %s in round %d.", verdict.Leader, change.Partition, change.Generation)
+	}
+
+	// brokers wait for the verdict; an empty one sends them away
+	for _, conn := range conns {
+		websocket.JSON.Send(conn, &verdict)
+	}
+
+	// the others only acknowledge, so just hear out the leader
+	acknowledged := false
+	for hp, conn := range conns {
+		var ack protocol.ElectionAck
+		err := websocket.JSON.Receive(conn, &ack)
+		conn.Close()
+		if hp != verdict.Leader || EMPTY == verdict.Leader {
+			continue
+		}
+		acknowledged = nil == err && ack.Leader && ack.Generation == change.Generation
+	}
+
+	switch {
+	case verdict.Leader == EMPTY:
+		return NO_CANDIDATES
+	case !acknowledged:
+		return fmt.Errorf("%s did not acknowledge its election.", verdict.Leader)
+	case unclean:
+		r.lost(change.Partition, verdict.Leader, states)
+	}
+
+	return nil
+
+}
+
+// Elect returns the broker with the most up-to-date log among the given log
+// states: the one whose last entry was written in the latest leader epoch,
+// then the one with the longest log. Ties are broken by hostport, so that the
+// result is deterministic. Returns EMPTY if there are no states.
+func Elect(states map[string]protocol.LogState) string {
+
+	winner := EMPTY
+	var best protocol.LogState
+
+	for hp, state := range states {
+		switch {
+		case winner == EMPTY:
+		case state.Epoch != best.Epoch:
+			if state.Epoch < best.Epoch {
+				continue
+			}
+		case state.Tail != best.Tail:
+			if state.Tail < best.Tail {
+				continue
+			}
+		case hp > winner:
+			continue
+		}
+		winner, best = hp, state
+	}
+
+	return winner
+
+}
+
+// brokers returns the live brokers. If no brokers are alive, the brokers seen
+// are returned. Caller must hold the lock.
+func (r *Register) brokers() []string {
+	brokers := r.live
+	if 0 == len(brokers) {
+		brokers = r.seenBrokers
+	}
+	return keys(brokers)
+}
+
+// leastLoaded returns the live broker that leads the fewest partitions. If no
+// brokers are alive, any seen broker is returned. Caller must hold the lock.
+func (r *Register) leastLoaded() string {
+
+	brokers := r.brokers()
+
+	load := make(map[string]int, len(brokers))
+	for _, leader := range r.leaders {
+		load[leader]++
+	}
+
+	least := EMPTY
+	for _, hp := range brokers {
+		if least == EMPTY || load[hp] < load[least] || (load[hp] == load[least] && hp < least) {
+			least = hp
+		}
+	}
+
+	return least
+
+}
+
+// CheckNewLeader runs rounds of election of a leader of the given partition
+// every interval until a leader is connected. Elections that fail too many
+// rounds in a row are reported as stuck.
+func (r *Register) CheckNewLeader(partition string) {
+
+	r.lock.Lock()
+	running := r.elections[partition]
+	r.elections[partition] = true
+	r.lock.Unlock()
+
+	// return if an instance already running
+	if running {
+		return
+	}
+
+	for r.IsLeader() && r.NoLeader(partition) {
+		err := r.LeaderDisconnect(partition)
+		time.Sleep(LEADERWAIT * time.Millisecond)
+		if nil == err && r.NoLeader(partition) {
+			err = fmt.Errorf("The elected leader did not become leader in %d ms.", LEADERWAIT)
+		}
+		r.endRound(partition, err)
+		log.Info("CheckNewLeader leader of %s is %v", partition, r.Leader(partition))
+	}
+
+	r.lock.Lock()
+	delete(r.elections, partition)
+	delete(r.rounds, partition)
+	r.lock.Unlock()
+
+	log.Info("Returning from CheckNewLeader")
+}
+
+// notifyBroker notifies a broker of a change in leader, and returns the state
+// of its log of the partition. The connection is left open for the verdict.
+func (r *Register) notifyBroker(broker string, change *protocol.LeaderChange) (*websocket.Conn, *protocol.LogState, error) {
+
+	log.Info("Notifying %v", broker)
+
+	conn, err := websocket.Dial("ws://"+broker+"/"+protocol.SWAP, "", "http://"+broker+"/")
+	if nil != err {
+		return nil, nil, err
+	}
+
+	// don't let an unresponsive broker hold up the election
+	conn.SetDeadline(time.Now().Add(LEADERWAIT * time.Millisecond))
+
+	if err := websocket.JSON.Send(conn, change); nil != err {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	state := new(protocol.LogState)
+	if err := websocket.JSON.Receive(conn, state); nil != err {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, state, nil
+
+}
+
+// GetInsyncSet returns a copy of the in-sync followers of the given partition
+func (r *Register) GetInsyncSet(partition string) map[string]bool {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	delete(r.insync, follower)
+	insync := make(map[string]bool, len(r.insync[partition]))
+	for hp, _ := range r.insync[partition] {
+		insync[hp] = true
+	}
+	return insync
 }
@@ -0,0 +1,402 @@
+package regimpl
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"octopi/api/protocol"
+	"octopi/util/test"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestElect ensures that the candidate with the most up-to-date log is
+// elected, preferring later epochs over longer logs.
+func TestElect(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.StringMatcher)
+
+	t.AssertEqual(matcher, EMPTY, Elect(map[string]protocol.LogState{}))
+
+	states := map[string]protocol.LogState{
+		"a:1": {Epoch: 2, Tail: 100},
+		"b:1": {Epoch: 3, Tail: 50},
+		"c:1": {Epoch: 3, Tail: 80},
+	}
+	t.AssertEqual(matcher, "c:1", Elect(states))
+
+	// ties are broken by hostport
+	states["d:1"] = protocol.LogState{Epoch: 3, Tail: 80}
+	t.AssertEqual(matcher, "c:1", Elect(states))
+
+}
+
+// TestSingleRegister ensures that a register without peers leads itself and
+// applies its own changes, and that a leader may reclaim its partition.
+func TestSingleRegister(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	register, err := NewRegister("localhost:1", nil, EMPTY)
+	t.AssertNil(err, "NewRegister")
+	t.AssertTrue(register.IsLeader(), "register.IsLeader")
+
+	epoch, ok, err := register.PromoteLeader("p", "a:1", 4, nil)
+	t.AssertNil(err, "register.PromoteLeader")
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertEqual(matcher, 5, int(epoch))
+
+	_, ok, err = register.PromoteLeader("p", "b:1", 5, nil)
+	t.AssertNil(err, "register.PromoteLeader")
+	t.AssertTrue(!ok, "register.PromoteLeader")
+
+	epoch, ok, err = register.PromoteLeader("p", "a:1", 5, nil)
+	t.AssertNil(err, "register.PromoteLeader")
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertEqual(matcher, 5, int(epoch))
+
+	t.AssertNil(register.AddFollower("p", "b:1"), "register.AddFollower")
+	t.AssertTrue(register.GetInsyncSet("p")["b:1"], "register.GetInsyncSet")
+
+}
+
+// TestAppend ensures that registers replace conflicting entries with those of
+// the leader, and only vote for candidates with up-to-date logs.
+func TestAppend(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	applied := 0
+	raft, err := NewRaft("a:1", []string{"b:1", "c:1"}, EMPTY, func(*protocol.RegisterCommand) interface{} {
+		applied++
+		return nil
+	}, func(bool) {}, func() []byte { return nil }, func([]byte) {})
+	t.AssertNil(err, "NewRaft")
+
+	command := protocol.RegisterCommand{Op: OP_JOIN}
+	entries := []protocol.RegisterEntry{{1, command}, {1, command}, {1, command}}
+	reply := raft.HandleAppend(&protocol.AppendRequest{Term: 1, Leader: "b:1", Entries: entries, Commit: 1})
+	t.AssertTrue(reply.Success, "raft.HandleAppend")
+	t.AssertEqual(matcher, 3, int(reply.Index))
+	t.AssertEqual(matcher, 1, applied)
+
+	// a gap is rejected
+	reply = raft.HandleAppend(&protocol.AppendRequest{Term: 2, Leader: "c:1", PrevIndex: 5, PrevTerm: 2})
+	t.AssertTrue(!reply.Success, "raft.HandleAppend")
+
+	// a conflicting entry is replaced, along with those after it
+	entries = []protocol.RegisterEntry{{2, command}}
+	reply = raft.HandleAppend(&protocol.AppendRequest{Term: 2, Leader: "c:1", PrevIndex: 1, PrevTerm: 1, Entries: entries, Commit: 2})
+	t.AssertTrue(reply.Success, "raft.HandleAppend")
+	t.AssertEqual(matcher, 2, int(raft.lastIndex()))
+	t.AssertEqual(matcher, 2, applied)
+
+	vote := raft.HandleVote(&protocol.VoteRequest{Term: 3, Candidate: "b:1", LastIndex: 3, LastTerm: 1})
+	t.AssertTrue(!vote.Granted, "raft.HandleVote")
+	vote = raft.HandleVote(&protocol.VoteRequest{Term: 3, Candidate: "b:1", LastIndex: 2, LastTerm: 2})
+	t.AssertTrue(vote.Granted, "raft.HandleVote")
+
+}
+
+// TestJournal ensures that a restarted register recovers its state from its
+// journal, ignoring a torn record at the end.
+func TestJournal(tester *testing.T) {
+
+	t := test.New(tester)
+	journal := filepath.Join(os.TempDir(), "test-register"+JOURNAL_EXT)
+	os.Remove(journal)
+	defer os.Remove(journal)
+
+	register, err := NewRegister("localhost:1", nil, journal)
+	t.AssertNil(err, "NewRegister")
+	_, ok, err := register.PromoteLeader("p", "a:1", 4, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertNil(register.AddFollower("p", "b:1"), "register.AddFollower")
+
+	file, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0666)
+	t.AssertNil(err, "os.OpenFile")
+	file.WriteString(`{"Term": 9, "Index": 1, "Entr`)
+	file.Close()
+
+	restarted, err := NewRegister("localhost:1", nil, journal)
+	t.AssertNil(err, "NewRegister")
+	t.AssertEqual(new(test.StringMatcher), "a:1", restarted.Leader("p"))
+	t.AssertEqual(new(test.IntMatcher), 5, int(restarted.Epoch("p")))
+	t.AssertTrue(restarted.GetInsyncSet("p")["b:1"], "register.GetInsyncSet")
+	t.AssertEqual(new(test.IntMatcher), 2, int(restarted.raft.term))
+
+}
+
+// TestSnapshot ensures that the log is compacted into a snapshot, from which a
+// restarted register recovers its state, and that registers that are behind
+// install snapshots sent by the leader.
+func TestSnapshot(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	journal := filepath.Join(os.TempDir(), "test-snapshot"+JOURNAL_EXT)
+	os.Remove(journal)
+	defer os.Remove(journal)
+
+	register, err := NewRegister("localhost:1", nil, journal)
+	t.AssertNil(err, "NewRegister")
+	register.raft.lock.Lock()
+	register.raft.threshold = 5
+	register.raft.lock.Unlock()
+
+	_, ok, err := register.PromoteLeader("p", "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	for i := 0; i < 10; i++ {
+		t.AssertNil(register.AddFollower("p", "b:1"), "register.AddFollower")
+	}
+
+	register.raft.lock.Lock()
+	t.AssertTrue(register.raft.snapIndex > 0, "raft.snapIndex")
+	t.AssertTrue(len(register.raft.entries) < 5, "raft.entries")
+	state := register.raft.state
+	index, term := register.raft.snapIndex, register.raft.snapTerm
+	register.raft.lock.Unlock()
+
+	restarted, err := NewRegister("localhost:1", nil, journal)
+	t.AssertNil(err, "NewRegister")
+	t.AssertEqual(new(test.StringMatcher), "a:1", restarted.Leader("p"))
+	t.AssertEqual(matcher, 1, int(restarted.Epoch("p")))
+	t.AssertTrue(restarted.GetInsyncSet("p")["b:1"], "register.GetInsyncSet")
+
+	// a register that is behind installs the snapshot, and appends after it
+	follower, err := NewRegister("localhost:2", []string{"localhost:1"}, EMPTY)
+	t.AssertNil(err, "NewRegister")
+	request := &protocol.SnapshotRequest{term, "localhost:1", index, term, state}
+	t.AssertTrue(follower.InstallSnapshot(request).Success, "register.InstallSnapshot")
+	t.AssertEqual(new(test.StringMatcher), "a:1", follower.Leader("p"))
+
+	entries := []protocol.RegisterEntry{{term, protocol.RegisterCommand{Op: OP_ADD, Partition: "p", HostPort: "c:1"}}}
+	reply := follower.Append(&protocol.AppendRequest{term, "localhost:1", index, term, entries, index + 1})
+	t.AssertTrue(reply.Success, "register.Append")
+	t.AssertEqual(matcher, int(index+1), int(reply.Index))
+	t.AssertTrue(follower.GetInsyncSet("p")["c:1"], "register.GetInsyncSet")
+
+}
+
+// TestStatus ensures that the status of a register reports partition leaders
+// and in-sync followers, and that leader transitions are recorded.
+func TestStatus(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	register, err := NewRegister("localhost:1", nil, EMPTY)
+	t.AssertNil(err, "NewRegister")
+
+	_, ok, err := register.PromoteLeader("p", "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertNil(register.AddFollower("p", "b:1"), "register.AddFollower")
+
+	status := register.Status()
+	t.AssertTrue(status.Leading, "status.Leading")
+	t.AssertEqual(new(test.StringMatcher), "a:1", status.Partitions["p"].Leader)
+	t.AssertEqual(matcher, 1, int(status.Partitions["p"].Epoch))
+	t.AssertEqual(matcher, 1, len(status.Partitions["p"].Insync))
+	t.AssertEqual(matcher, 2, len(status.Brokers))
+
+	t.AssertNil(register.LeaderDisconnected("p", "a:1", nil), "register.LeaderDisconnected")
+	history := register.History()
+	t.AssertEqual(matcher, 2, len(history))
+	t.AssertEqual(new(test.StringMatcher), "a:1", history[0].Leader)
+	t.AssertEqual(new(test.StringMatcher), EMPTY, history[1].Leader)
+
+}
+
+// testConn is a connection held by a broker, which records whether it was
+// closed.
+type testConn struct {
+	closed bool
+}
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// TestDecommission ensures that decommissioned brokers are forgotten and
+// disconnected, and refused until they are recommissioned, and that brokers
+// that have not been seen for long enough expire.
+func TestDecommission(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	register, err := NewRegister("localhost:1", nil, EMPTY)
+	t.AssertNil(err, "NewRegister")
+
+	member := new(testConn)
+	_, err = register.Join("a:1", nil, member)
+	t.AssertNil(err, "register.Join")
+	_, ok, err := register.PromoteLeader("p", "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertNil(register.AddFollower("p", "a:1"), "register.AddFollower")
+	t.AssertNil(register.AddFollower("p", "b:1"), "register.AddFollower")
+
+	// only POSTs are accepted
+	server := NewServer(register, time.Second)
+	for _, method := range []string{"GET", "POST"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, "/decommission?broker=a:1", nil)
+		server.decommission(recorder, request)
+		t.AssertTrue((recorder.Code == http.StatusMethodNotAllowed) == ("GET" == method), "server.decommission")
+		t.AssertTrue(member.closed == ("POST" == method), "member.closed")
+	}
+	t.AssertTrue(register.NoLeader("p"), "register.NoLeader")
+	t.AssertTrue(!register.GetInsyncSet("p")["a:1"], "register.GetInsyncSet")
+	t.AssertEqual(matcher, 1, len(register.Status().Brokers))
+	t.AssertEqual(matcher, 1, len(register.Status().Retired))
+
+	_, err = register.Join("a:1", nil, new(testConn))
+	t.AssertEqual(new(test.StringMatcher), DECOMMISSIONED.Error(), err.Error())
+	_, ok, err = register.PromoteLeader("p", "a:1", 1, nil)
+	t.AssertTrue(!ok, "register.PromoteLeader")
+	t.AssertNil(register.AddFollower("p", "a:1"), "register.AddFollower")
+	t.AssertTrue(!register.GetInsyncSet("p")["a:1"], "register.GetInsyncSet")
+
+	t.AssertNil(register.Recommission("a:1"), "register.Recommission")
+	_, err = register.Join("a:1", nil, member)
+	t.AssertNil(err, "register.Join")
+
+	// b:1 is not live, so it expires once seen long enough ago
+	register.expire(time.Hour)
+	t.AssertTrue(register.GetInsyncSet("p")["b:1"], "register.GetInsyncSet")
+	register.Leave(member)
+	register.expire(0)
+	t.AssertTrue(!register.GetInsyncSet("p")["b:1"], "register.GetInsyncSet")
+	t.AssertEqual(matcher, 0, len(register.Status().Brokers))
+
+}
+
+// TestMetadata ensures that metadata describes live brokers and the
+// partitions of the requested topics, with the tails reported by leaders.
+func TestMetadata(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	register, err := NewRegister("localhost:1", nil, EMPTY)
+	t.AssertNil(err, "NewRegister")
+
+	_, err = register.Join("a:1", nil, new(testConn))
+	t.AssertNil(err, "register.Join")
+	_, ok, err := register.PromoteLeader("t", "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	_, ok, err = register.PromoteLeader(protocol.PartitionName("t", 1), "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	_, ok, err = register.PromoteLeader("u", "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertNil(register.AddFollower("t", "b:1"), "register.AddFollower")
+	register.ReportTail("t", 40)
+
+	metadata := register.Metadata([]string{"t"})
+	t.AssertEqual(matcher, 1, len(metadata.Brokers))
+	t.AssertEqual(matcher, 2, len(metadata.Partitions))
+
+	p := metadata.Partitions[0]
+	t.AssertEqual(new(test.StringMatcher), "t", p.Topic)
+	t.AssertEqual(matcher, 0, p.Partition)
+	t.AssertEqual(new(test.StringMatcher), "a:1", string(p.Leader))
+	t.AssertEqual(matcher, 1, len(p.Insync))
+	t.AssertEqual(matcher, 40, int(p.Tail))
+	t.AssertEqual(matcher, 1, metadata.Partitions[1].Partition)
+
+	t.AssertEqual(matcher, 3, len(register.Metadata(nil).Partitions))
+
+}
+
+// TestStuckElection ensures that a round of an election is only started again
+// once brokers change, each with a new generation, and that elections that
+// fail too many times are reported.
+func TestStuckElection(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	register, err := NewRegister("localhost:1", nil, EMPTY)
+	t.AssertNil(err, "NewRegister")
+
+	_, ok, err := register.PromoteLeader("p", "a:1", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	t.AssertNil(register.LeaderDisconnected("p", "a:1", nil), "register.LeaderDisconnected")
+
+	// nothing listens on this port
+	t.AssertNil(register.AddFollower("p", "localhost:2"), "register.AddFollower")
+
+	// rounds are only started again once a broker joins or leaves
+	for i := 1; i <= STUCK_ROUNDS; i++ {
+		err := register.LeaderDisconnect("p")
+		t.AssertNotNil(err, "register.LeaderDisconnect")
+		register.endRound("p", err)
+		election := register.Status().Partitions["p"].Election
+		t.AssertEqual(matcher, 1, int(election.Generation))
+		t.AssertEqual(matcher, i, election.Failures)
+		t.AssertTrue(election.Problem == NO_CANDIDATES.Error(), "election.Problem")
+		t.AssertTrue(election.Stuck == (i == STUCK_ROUNDS), "election.Stuck")
+	}
+
+	t.AssertNil(register.AddFollower("p", "localhost:3"), "register.AddFollower")
+	register.endRound("p", register.LeaderDisconnect("p"))
+	election := register.Status().Partitions["p"].Election
+	t.AssertEqual(matcher, 2, int(election.Generation))
+
+}
+
+// testBroker takes part in elections, reporting a log of 10 bytes.
+func testBroker(conn *websocket.Conn) {
+	defer conn.Close()
+	var change protocol.LeaderChange
+	if nil != websocket.JSON.Receive(conn, &change) {
+		return
+	}
+	websocket.JSON.Send(conn, &protocol.LogState{Epoch: 1, Tail: 10})
+	if nil != websocket.JSON.Receive(conn, &change) {
+		return
+	}
+	leading := change.Leader == "localhost:11121"
+	websocket.JSON.Send(conn, &protocol.ElectionAck{Generation: change.Generation, Leader: leading})
+}
+
+// TestUncleanElection ensures that partitions without in-sync brokers wait for
+// them to return, unless unclean elections are allowed, in which case the
+// data lost is recorded.
+func TestUncleanElection(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.IntMatcher)
+	register, err := NewRegister("localhost:1", nil, EMPTY)
+	t.AssertNil(err, "NewRegister")
+
+	listener, err := net.Listen("tcp", ":11121")
+	t.AssertNil(err, "net.Listen")
+	defer listener.Close()
+	go http.Serve(listener, websocket.Handler(testBroker))
+
+	_, err = register.Join("localhost:11121", nil, new(testConn))
+	t.AssertNil(err, "register.Join")
+
+	// nothing listens on the port of the leader
+	_, ok, err := register.PromoteLeader("p", "localhost:2", 0, nil)
+	t.AssertTrue(ok, "register.PromoteLeader")
+	register.ReportTail("p", 50)
+	t.AssertNil(register.LeaderDisconnected("p", "localhost:2", nil), "register.LeaderDisconnected")
+
+	t.AssertNotNil(register.LeaderDisconnect("p"), "register.LeaderDisconnect")
+	t.AssertNotNil(register.LeaderDisconnect("p"), "register.LeaderDisconnect")
+	t.AssertEqual(matcher, 0, len(register.DataLosses()))
+
+	register.SetUncleanElection(true)
+	t.AssertNotNil(register.LeaderDisconnect("p"), "register.LeaderDisconnect")
+	t.AssertNil(register.LeaderDisconnect("p"), "register.LeaderDisconnect")
+
+	losses := register.DataLosses()
+	t.AssertEqual(matcher, 1, len(losses))
+	t.AssertEqual(new(test.StringMatcher), "localhost:11121", losses[0].Leader)
+	t.AssertEqual(matcher, 10, int(losses[0].Tail))
+	t.AssertEqual(matcher, 50, int(losses[0].Truncated["localhost:2"]))
+
+}
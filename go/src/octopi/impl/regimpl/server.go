@@ -0,0 +1,406 @@
+package regimpl
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"octopi/api/protocol"
+	"octopi/util/log"
+	"time"
+)
+
+// Servers serve the endpoints of a register: websocket endpoints for brokers,
+// clients and other registers, and plain http endpoints for admins.
+type Server struct {
+	register       *Register
+	sessionTimeout time.Duration // max time to wait for a heartbeat from a leader
+}
+
+// NewServer returns a new Server for the given register. Leaders that do not
+// send a heartbeat within the given session timeout are disconnected.
+func NewServer(register *Register, sessionTimeout time.Duration) *Server {
+	return &Server{register, sessionTimeout}
+}
+
+// Handle registers the endpoints of the register with the given mux.
+func (s *Server) Handle(mux *http.ServeMux) {
+	mux.Handle("/"+protocol.LEADER, websocket.Handler(s.leaderHandler))
+	mux.Handle("/"+protocol.JOIN, websocket.Handler(s.joinHandler))
+	mux.Handle("/"+protocol.FOLLOW, websocket.Handler(s.followHandler))
+	mux.Handle("/"+protocol.PUBLISH, websocket.Handler(s.publishHandler))
+	mux.Handle("/"+protocol.SUBSCRIBE, websocket.Handler(s.subscribeHandler))
+	mux.Handle("/"+protocol.METADATA, websocket.Handler(s.metadataHandler))
+	mux.Handle("/"+protocol.VOTE, websocket.Handler(s.voteHandler))
+	mux.Handle("/"+protocol.APPEND, websocket.Handler(s.appendHandler))
+	mux.Handle("/"+protocol.SNAPSHOT, websocket.Handler(s.snapshotHandler))
+	mux.HandleFunc("/"+protocol.STATUS, s.status)
+	mux.HandleFunc("/"+protocol.HISTORY, s.history)
+	mux.HandleFunc("/"+protocol.LOSSES, s.losses)
+	mux.HandleFunc("/"+protocol.DECOMMISSION, s.decommission)
+	mux.HandleFunc("/"+protocol.RECOMMISSION, s.recommission)
+}
+
+// leaderHandler handles brokers that are trying to initiate
+// leader connections with the register for a partition. Refuses
+// the connection if the partition already has a leader
+func (s *Server) leaderHandler(ws *websocket.Conn) {
+
+	defer ws.Close()
+
+	var request protocol.LeaderRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err {
+		log.Warn("Ignoring invalid message from %v", ws.RemoteAddr())
+		return
+	}
+
+	leaderhp := request.HostPort
+	partition := request.Partition
+
+	log.Info("Received leader request for %s from %v", partition, leaderhp)
+
+	if s.forward(ws) {
+		return
+	}
+
+	// refuse the request if there is already a leader
+	epoch, ok, err := s.register.PromoteLeader(partition, string(leaderhp), request.Epoch, ws)
+	if nil != err {
+		websocket.JSON.Send(ws, &protocol.Ack{Status: protocol.StatusNotReady})
+		return
+	}
+	if !ok {
+		ack := protocol.Ack{Status: protocol.StatusFailure, Epoch: epoch}
+		websocket.JSON.Send(ws, &ack)
+		return
+	}
+
+	log.Info("Made %v leader of %s with epoch %d", leaderhp, partition, epoch)
+
+	// the leader has disconnected once this returns
+	defer func() {
+		s.register.LeaderDisconnected(partition, string(leaderhp), ws)
+		go s.register.CheckNewLeader(partition)
+	}()
+
+	ack := protocol.Ack{Status: protocol.StatusSuccess, Epoch: epoch}
+	if err := websocket.JSON.Send(ws, &ack); nil != err {
+		return
+	}
+
+	for {
+		var change protocol.InsyncChange
+		ws.SetReadDeadline(time.Now().Add(s.sessionTimeout))
+		err := websocket.JSON.Receive(ws, &change)
+
+		// leader has disconnected, or stopped sending heartbeats!
+		if nil != err {
+			log.Warn("Lost leader %v of %s: %s", leaderhp, partition, err.Error())
+			return
+		}
+
+		// ignore changes from older leaders
+		if change.Epoch != epoch {
+			log.Warn("Ignoring change from %v with stale epoch %d", leaderhp, change.Epoch)
+			continue
+		}
+
+		if change.Type == protocol.HEARTBEAT {
+			s.register.ReportTail(partition, change.Tail)
+			ack := protocol.Ack{Status: protocol.StatusSuccess, Epoch: epoch}
+			err = websocket.JSON.Send(ws, &ack)
+		} else if change.Type == protocol.HANDOFF {
+			// elect the chosen follower once the leader disconnects
+			log.Info("Leader of %s is handing off to %v", partition, change.HostPort)
+			s.register.Prefer(partition, string(change.HostPort))
+			return
+		} else if change.Type == protocol.ADD {
+			log.Info("Leader of %s added an in-sync follower: %v", partition, change.HostPort)
+			// add a new follower
+			err = s.register.AddFollower(partition, string(change.HostPort))
+		} else if change.Type == protocol.REMOVE {
+			log.Info("Leader of %s removed an in-sync follower: %v", partition, change.HostPort)
+			// remove a follower
+			err = s.register.RemoveFollower(partition, string(change.HostPort))
+		} else {
+			// ignore invalid message
+			log.Warn("Ignoring invalid message from %v", ws.RemoteAddr())
+			continue
+		}
+
+		// disconnect so that the leader reconnects to the leading register
+		if nil != err {
+			log.Warn("Unable to record change from %v: %s", leaderhp, err.Error())
+			return
+		}
+	}
+}
+
+// joinHandler handles brokers that are joining the broker set. The
+// register replies with all known partitions, and holds the connection
+// for as long as the broker is alive.
+func (s *Server) joinHandler(ws *websocket.Conn) {
+
+	defer ws.Close()
+
+	var request protocol.JoinRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err {
+		log.Warn("Ignoring invalid message from %v", ws.RemoteAddr())
+		return
+	}
+
+	if s.forward(ws) {
+		return
+	}
+
+	hostport := string(request.HostPort)
+	partitions, err := s.register.Join(hostport, request.Partitions, ws)
+	if DECOMMISSIONED == err {
+		log.Warn("Refusing decommissioned broker %v", hostport)
+		websocket.JSON.Send(ws, &protocol.Ack{Status: protocol.StatusFailure})
+		return
+	}
+	if nil != err {
+		websocket.JSON.Send(ws, &protocol.Ack{Status: protocol.StatusNotReady})
+		return
+	}
+	log.Info("Broker %v joined with partitions %v", hostport, request.Partitions)
+
+	payload, _ := json.Marshal(partitions)
+	ack := protocol.Ack{Status: protocol.StatusSuccess, Payload: payload}
+	if err := websocket.JSON.Send(ws, &ack); nil == err {
+		// block until the broker goes away
+		for {
+			var ignored interface{}
+			if err := websocket.JSON.Receive(ws, &ignored); nil != err {
+				break
+			}
+		}
+	}
+
+	s.register.Leave(ws)
+	log.Info("Broker %v has left", hostport)
+}
+
+// followHandler redirects followers to the leader of the partition that
+// they wish to follow.
+func (s *Server) followHandler(ws *websocket.Conn) {
+	var request protocol.FollowRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err || s.forward(ws) {
+		ws.Close()
+		return
+	}
+	s.redirect(ws, request.Partition, s.register.Leader(request.Partition))
+}
+
+// publishHandler redirects producers to the leader of the partition that
+// they wish to publish to.
+func (s *Server) publishHandler(ws *websocket.Conn) {
+	var request protocol.ProduceRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err || s.forward(ws) {
+		ws.Close()
+		return
+	}
+	partition := protocol.PartitionName(request.Topic, request.Partition)
+	s.redirect(ws, partition, s.register.Leader(partition))
+}
+
+// subscribeHandler redirects consumers to the leader or an in-sync follower
+// of the partition that they wish to subscribe to, so that reads are spread
+// across the brokers that hold the partition.
+func (s *Server) subscribeHandler(ws *websocket.Conn) {
+	var request protocol.SubscribeRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err || s.forward(ws) {
+		ws.Close()
+		return
+	}
+	partition := protocol.PartitionName(request.Topic, request.Partition)
+	s.redirect(ws, partition, s.register.Reader(partition))
+}
+
+// metadataHandler replies to clients with the brokers of the cluster, and the
+// leader, in-sync followers and tail of the partitions of the topics that they
+// ask about.
+func (s *Server) metadataHandler(ws *websocket.Conn) {
+
+	defer ws.Close()
+
+	var request protocol.MetadataRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err || s.forward(ws) {
+		return
+	}
+
+	payload, _ := json.Marshal(s.register.Metadata(request.Topics))
+	websocket.JSON.Send(ws, &protocol.Ack{Status: protocol.StatusSuccess, Payload: payload})
+
+}
+
+// forward redirects the sender to the leading register if this register does
+// not lead the register cluster, and returns true if it did so.
+func (s *Server) forward(ws *websocket.Conn) bool {
+
+	if s.register.IsLeader() {
+		return false
+	}
+
+	var redirect protocol.Ack
+	if leader := s.register.ClusterLeader(); leader == EMPTY {
+		redirect.Status = protocol.StatusNotReady
+	} else {
+		redirect.Status = protocol.StatusRedirect
+		redirect.Payload = []byte(leader)
+	}
+
+	websocket.JSON.Send(ws, redirect)
+	return true
+
+}
+
+// voteHandler handles vote requests from other registers.
+func (s *Server) voteHandler(ws *websocket.Conn) {
+	defer ws.Close()
+	var request protocol.VoteRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err {
+		return
+	}
+	websocket.JSON.Send(ws, s.register.Vote(&request))
+}
+
+// appendHandler handles entries and heartbeats from the leading register.
+func (s *Server) appendHandler(ws *websocket.Conn) {
+	defer ws.Close()
+	var request protocol.AppendRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err {
+		return
+	}
+	websocket.JSON.Send(ws, s.register.Append(&request))
+}
+
+// snapshotHandler handles snapshots from the leading register.
+func (s *Server) snapshotHandler(ws *websocket.Conn) {
+	defer ws.Close()
+	var request protocol.SnapshotRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err {
+		return
+	}
+	websocket.JSON.Send(ws, s.register.InstallSnapshot(&request))
+}
+
+// redirect ACKs the new follower/producer/consumer with a redirect
+// to the given broker if a leader of the partition is determined. if
+// not, starts an election and disconnects.
+func (s *Server) redirect(ws *websocket.Conn, partition string, target string) {
+
+	defer ws.Close()
+
+	var redirect protocol.Ack
+
+	if target == EMPTY {
+		redirect.Status = protocol.StatusNotReady
+		log.Info("We have no established leader for %s now!", partition)
+		go s.register.CheckNewLeader(partition)
+	} else {
+		redirect.Status = protocol.StatusRedirect
+		redirect.Payload = []byte(target)
+		redirect.Epoch = s.register.Epoch(partition)
+	}
+
+	log.Info("Redirect sending payload for %s: %v", partition, target)
+	// don't need to check if disconnect
+	websocket.JSON.Send(ws, redirect)
+}
+
+// status handles requests for the state of the register: the leader, leader
+// epoch and uptime, and in-sync followers of every partition, and every broker
+// seen, with whether it is live. Responds with JSON. Registers that do not
+// lead the register cluster respond too, naming the leading register.
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	respond(w, s.register.Status())
+}
+
+// history handles requests for the most recent leader transitions, oldest
+// first. Responds with JSON.
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	respond(w, s.register.History())
+}
+
+// losses handles requests for the most recent unclean elections, with the
+// brokers whose logs are truncated, oldest first. Responds with JSON.
+func (s *Server) losses(w http.ResponseWriter, r *http.Request) {
+	respond(w, s.register.DataLosses())
+}
+
+// respond writes the given value to the response as JSON.
+func respond(w http.ResponseWriter, value interface{}) {
+
+	body, err := json.MarshalIndent(value, "", "  ")
+	if nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+
+}
+
+// decommission handles requests to decommission a broker, e.g. before it is
+// retired. The broker is given as a query parameter, e.g.
+// /decommission?broker=localhost:12346, and the request must be a POST. It is
+// forgotten, its partitions are given new leaders, and it is refused if it
+// joins again until it is recommissioned. Only the leading register accepts
+// the request.
+func (s *Server) decommission(w http.ResponseWriter, r *http.Request) {
+
+	if !post(w, r) {
+		return
+	}
+
+	hostport := r.FormValue("broker")
+	if "" == hostport {
+		http.Error(w, "missing broker", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.register.Decommission(hostport); nil != err {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	fmt.Fprintf(w, "decommissioned %s\n", hostport)
+
+}
+
+// recommission handles requests to allow a decommissioned broker to join
+// again, e.g. a POST to /recommission?broker=localhost:12346.
+func (s *Server) recommission(w http.ResponseWriter, r *http.Request) {
+
+	if !post(w, r) {
+		return
+	}
+
+	hostport := r.FormValue("broker")
+	if "" == hostport {
+		http.Error(w, "missing broker", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.register.Recommission(hostport); nil != err {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	fmt.Fprintf(w, "recommissioned %s\n", hostport)
+
+}
+
+// post returns true iff the request is a POST, and answers it with 405 Method
+// Not Allowed otherwise.
+func post(w http.ResponseWriter, r *http.Request) bool {
+	if http.MethodPost == r.Method {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,85 @@
+package regimpl
+
+import (
+	"encoding/json"
+	"octopi/util/log"
+	"time"
+)
+
+// States are the replicated state of a register, as held in snapshots. Soft
+// state, such as the brokers that are live, is kept by the leading register
+// only, and is not part of it.
+type State struct {
+	Leaders     map[string]string          // map of partitions to leaders
+	Previous    map[string]string          // map of partitions to last leaders
+	Epochs      map[string]int64           // map of partitions to leader epochs
+	Insync      map[string]map[string]bool // map of partitions to in-sync sets
+	Generations map[string]int64           // map of partitions to election rounds
+	SeenBrokers map[string]bool            // brokers seen
+	Retired     map[string]bool            // decommissioned brokers
+	Since       map[string]time.Time       // times at which leaders were elected
+	History     []Transition               // recent leader transitions
+	Losses      []DataLoss                 // recent unclean elections
+}
+
+// snapshot returns the replicated state of the register, encoded.
+func (r *Register) snapshot() []byte {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	data, err := json.Marshal(&State{
+		Leaders:     r.leaders,
+		Previous:    r.previous,
+		Epochs:      r.epochs,
+		Insync:      r.insync,
+		Generations: r.generations,
+		SeenBrokers: r.seenBrokers,
+		Retired:     r.retired,
+		Since:       r.since,
+		History:     r.history,
+		Losses:      r.losses,
+	})
+
+	if nil != err {
+		log.Panic("Unable to snapshot register: %s", err.Error())
+	}
+
+	return data
+
+}
+
+// restore replaces the replicated state of the register with the given
+// snapshot.
+func (r *Register) restore(data []byte) {
+
+	state := &State{
+		Leaders:     make(map[string]string),
+		Previous:    make(map[string]string),
+		Epochs:      make(map[string]int64),
+		Insync:      make(map[string]map[string]bool),
+		Generations: make(map[string]int64),
+		SeenBrokers: make(map[string]bool),
+		Retired:     make(map[string]bool),
+		Since:       make(map[string]time.Time),
+	}
+
+	if err := json.Unmarshal(data, state); nil != err {
+		log.Panic("Unable to restore register: %s", err.Error())
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.leaders = state.Leaders
+	r.previous = state.Previous
+	r.epochs = state.Epochs
+	r.insync = state.Insync
+	r.generations = state.Generations
+	r.seenBrokers = state.SeenBrokers
+	r.retired = state.Retired
+	r.since = state.Since
+	r.history = state.History
+	r.losses = state.Losses
+
+}
@@ -0,0 +1,117 @@
+package regimpl
+
+import (
+	"octopi/api/protocol"
+	"sort"
+	"time"
+)
+
+// Number of leader transitions kept in the history.
+const HISTORY_SIZE = 100
+
+// Statuses describe the state of a register and of the brokers it manages.
+type Status struct {
+	Register      string                     // host:port of this register
+	ClusterLeader string                     // host:port of the leading register
+	Leading       bool                       // true iff this register leads
+	Partitions    map[string]PartitionStatus // partitions by name
+	Brokers       map[string]bool            // seen brokers, and whether they are live
+	Retired       []string                   // decommissioned brokers
+}
+
+// PartitionStatuses describe the leadership of a partition.
+type PartitionStatus struct {
+	Leader   string    // host:port of the leader; empty if there is none
+	Epoch    int64     // leader epoch
+	Since    time.Time // time at which the leader was elected
+	Uptime   int64     // ms since the leader was elected
+	Insync   []string  // in-sync followers
+	Election *Round    // latest round of the election in progress, if any
+}
+
+// Transitions record a change of the leader of a partition.
+type Transition struct {
+	Partition string    // name of partition
+	Leader    string    // new leader; empty if the leader disconnected
+	Epoch     int64     // leader epoch
+	Time      time.Time // time of the change
+}
+
+// Status returns the state of this register. Only the leading register knows
+// which brokers are live.
+func (r *Register) Status() *Status {
+
+	status := &Status{
+		Register:      r.raft.id,
+		ClusterLeader: r.ClusterLeader(),
+		Leading:       r.IsLeader(),
+		Partitions:    make(map[string]PartitionStatus),
+		Brokers:       make(map[string]bool),
+		Retired:       make([]string, 0),
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for partition, leader := range r.leaders {
+		p := PartitionStatus{
+			Leader: leader,
+			Epoch:  r.epochs[partition],
+			Insync: make([]string, 0, len(r.insync[partition])),
+		}
+		if leader != EMPTY {
+			p.Since = r.since[partition]
+			p.Uptime = int64(time.Since(p.Since) / time.Millisecond)
+		}
+		for hp, _ := range r.insync[partition] {
+			p.Insync = append(p.Insync, hp)
+		}
+		sort.Strings(p.Insync)
+		if round, exists := r.rounds[partition]; exists {
+			election := *round
+			p.Election = &election
+		}
+		status.Partitions[partition] = p
+	}
+
+	for hp, _ := range r.seenBrokers {
+		status.Brokers[hp] = r.live[hp]
+	}
+
+	for hp, _ := range r.retired {
+		status.Retired = append(status.Retired, hp)
+	}
+	sort.Strings(status.Retired)
+
+	return status
+
+}
+
+// History returns the most recent leader transitions, oldest first.
+func (r *Register) History() []Transition {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Transition(nil), r.history...)
+}
+
+// record adds a transition of the partition named by the given command to the
+// given leader to the history. Caller must hold the lock.
+func (r *Register) record(command *protocol.RegisterCommand, leader string) {
+
+	at := time.Unix(0, command.Time*int64(time.Millisecond))
+	if leader != EMPTY {
+		r.since[command.Partition] = at
+	}
+
+	r.history = append(r.history, Transition{
+		Partition: command.Partition,
+		Leader:    leader,
+		Epoch:     r.epochs[command.Partition],
+		Time:      at,
+	})
+
+	if len(r.history) > HISTORY_SIZE {
+		r.history = r.history[len(r.history)-HISTORY_SIZE:]
+	}
+
+}
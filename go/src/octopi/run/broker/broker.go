@@ -6,9 +6,37 @@
 //
 // Configuration Options:
 //    port:     port number of broker; it will listen for connections on this port
-//    register: host:port of register/leader for this broker to register
+//    register: host:port of register for this broker to join, or a
+//              comma-separated list of the registers in a register cluster
 //    log_dir:  path to log directory
-//    role:     launch as leader/follower
+//    partitions:       number of partitions of each topic
+//    max_lag_time:     ms a follower may lag before it is evicted from the
+//                      in-sync set
+//    max_lag_messages: number of messages a follower may lag before it is
+//                      evicted from the in-sync set
+//    snapshot_threshold: bytes a follower may lag before its log is caught up
+//                        with bulk transfers
+//    snapshot_chunk:     max bytes sent in each bulk transfer
+//    catch_up_rate:    max bytes per second sent to followers catching up;
+//                      can be changed at runtime through /throttle
+//    replication_rate: max bytes per second sent to in-sync followers;
+//                      can be changed at runtime through /throttle
+//    heartbeat_interval: ms between heartbeats sent by leaders
+//    session_timeout:    ms to wait for a message from the register, a leader
+//                        or a follower before giving up on it
+//    lease_timeout:      ms for which leadership is held after the register
+//                        answers a heartbeat; below the register's
+//                        session_timeout
+//    peers:    comma-separated list of the host:ports of every broker in the
+//              cluster, including this one, to run without a separate
+//              register; replaces register
+//    register_offset: each broker's embedded register listens on the port of
+//                     the broker plus this offset, if peers is set; the same
+//                     on every broker, 1000 by default
+//    broker_expiry: ms after which brokers that have not been seen are
+//                   forgotten, if peers is set
+//    unclean_election: whether brokers that are not in sync may be elected,
+//                      losing data, if peers is set
 package main
 
 import (
@@ -60,6 +88,12 @@ func main() {
 
 	log.SetPrefix(fmt.Sprintf("broker@%d: ", port))
 
+	// without a separate register, brokers run one each
+	static := &brokerimpl.Config{*config}
+	if 0 != len(static.Peers()) {
+		checkError(startRegister(static))
+	}
+
 	broker, err = brokerimpl.New(config)
 	checkError(err)
 
@@ -74,6 +108,9 @@ func listenHttp(port int) {
 	http.Handle("/"+protocol.FOLLOW, websocket.Handler(follower))
 	http.Handle("/"+protocol.SUBSCRIBE, websocket.Handler(consumer))
 	http.Handle("/"+protocol.SWAP, websocket.Handler(register))
+	http.HandleFunc("/"+protocol.THROTTLE, throttle)
+	http.HandleFunc("/"+protocol.TRANSFER, transfer)
+	http.Handle("/"+protocol.METADATA, websocket.Handler(metadata))
 	log.Info("HTTP server started on %d.", port)
 	http.ListenAndServe(":"+strconv.Itoa(port), nil)
 }
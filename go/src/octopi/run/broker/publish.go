@@ -2,8 +2,10 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"encoding/json"
 	"io"
 	"octopi/api/protocol"
+	"octopi/impl/brokerimpl"
 	"octopi/util/log"
 )
 
@@ -29,13 +31,20 @@ func producer(conn *websocket.Conn) {
 		}
 
 		ack := new(protocol.Ack)
-		if err := broker.Publish(request.Topic, request.ID, &request.Message); nil != err {
+		receipt, err := publish(&request)
+		switch err {
+		case nil:
+			ack.Status = protocol.StatusSuccess
+			ack.Payload = receipt
+		case brokerimpl.NOT_LEADER:
+			// redirect to the leader of the partition
+			ack.Status = protocol.StatusRedirect
+			ack.Payload = []byte(broker.Leader(request.Topic, request.Partition))
+		default:
 			log.Error(err.Error())
 			ack.Status = protocol.StatusFailure
-		} else {
-			ack.Status = protocol.StatusSuccess
 		}
-		// TODO: should redirect if this node is not the leader
+		ack.Epoch = broker.Epoch(request.Topic, request.Partition)
 
 		websocket.JSON.Send(conn, &ack)
 
@@ -44,3 +53,21 @@ func producer(conn *websocket.Conn) {
 	log.Info("Closed producer connection from %v.", conn.RemoteAddr())
 
 }
+
+// publish publishes the message, or the batch of messages, in the given
+// request, and returns the encoded receipt.
+func publish(request *protocol.ProduceRequest) ([]byte, error) {
+
+	messages := request.Messages
+	if 0 == len(messages) {
+		messages = []protocol.Message{request.Message}
+	}
+
+	offsets, err := broker.PublishBatch(request.Topic, request.Partition, request.ID, messages)
+	if nil != err {
+		return nil, err
+	}
+
+	return json.Marshal(&protocol.ProduceReceipt{request.Topic, request.Partition, offsets})
+
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"fmt"
+	"net"
+	"net/http"
+	"octopi/api/protocol"
+	"octopi/impl/brokerimpl"
+	"octopi/impl/regimpl"
+	"octopi/util/log"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Default time in ms after which brokers that have not been seen are
+// forgotten by the embedded register.
+const BROKER_EXPIRY = "86400000"
+
+// startRegister starts the register embedded in this broker, for brokers that
+// are configured with a static list of peers instead of registers. The
+// registers embedded in the peers form a register cluster, so the brokers
+// elect leaders among themselves. Each listens on the port of its broker
+// offset by the register_offset option.
+func startRegister(options *brokerimpl.Config) error {
+
+	origin := fmt.Sprintf("%s:%d", options.Host(), options.Port())
+	id := protocol.StaticRegister(origin, options.RegisterOffset())
+
+	peers := make([]string, 0)
+	found := false
+	for _, hostport := range options.Registers() {
+		if hostport == id {
+			found = true
+		} else {
+			peers = append(peers, hostport)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("Peers must include this broker, %s.", origin)
+	}
+
+	expiry, err := strconv.Atoi(options.Get("broker_expiry", BROKER_EXPIRY))
+	if nil != err {
+		return err
+	}
+
+	unclean, err := strconv.ParseBool(options.Get("unclean_election", "false"))
+	if nil != err {
+		return err
+	}
+
+	// listen first, so that the broker does not start if the port is taken
+	_, port, _ := net.SplitHostPort(id)
+	listener, err := net.Listen("tcp", ":"+port)
+	if nil != err {
+		return err
+	}
+
+	journal := filepath.Join(options.LogDir(), "register-"+port+regimpl.JOURNAL_EXT)
+	log.Info("Starting embedded register %s with peers %v.", id, peers)
+	register, err := regimpl.NewRegister(id, peers, journal)
+	if nil != err {
+		listener.Close()
+		return err
+	}
+
+	register.SetUncleanElection(unclean)
+	if expiry > 0 {
+		go register.ExpireBrokers(time.Duration(expiry) * time.Millisecond)
+	}
+
+	mux := http.NewServeMux()
+	regimpl.NewServer(register, options.SessionTimeout()).Handle(mux)
+	go http.Serve(listener, mux)
+	return nil
+
+}
+
+// metadata redirects clients that ask this broker for metadata to the
+// register embedded in it, which answers for the cluster.
+func metadata(ws *websocket.Conn) {
+
+	defer ws.Close()
+
+	var request protocol.MetadataRequest
+	if err := websocket.JSON.Receive(ws, &request); nil != err {
+		return
+	}
+
+	redirect := &protocol.Ack{
+		Status:  protocol.StatusRedirect,
+		Payload: []byte(broker.StaticRegister()),
+	}
+	websocket.JSON.Send(ws, redirect)
+
+}
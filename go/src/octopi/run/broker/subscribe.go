@@ -8,14 +8,20 @@ import (
 	"octopi/util/log"
 )
 
+// partition identifies a partition of a topic.
+type partition struct {
+	topic string
+	id    int
+}
+
 // consumer handles incoming subscribe requests. Consumers may send
 // multiple subscribe requests on the same persistent connection. However,
-// consumers may only subscribe to the same topic once. The function exits when
-// an `io.EOF` is received on the connection.
+// consumers may only subscribe to the same partition of a topic once. The
+// function exits when an `io.EOF` is received on the connection.
 func consumer(conn *websocket.Conn) {
 
 	defer conn.Close()
-	subscriptions := make(map[string]*brokerimpl.Subscription)
+	subscriptions := make(map[partition]*brokerimpl.Subscription)
 
 	for {
 
@@ -32,7 +38,8 @@ func consumer(conn *websocket.Conn) {
 			continue
 		}
 
-		if _, exists := subscriptions[request.Topic]; exists {
+		key := partition{request.Topic, request.Partition}
+		if _, exists := subscriptions[key]; exists {
 			log.Warn("Ignoring duplicate subscribe request from %v.",
 				conn.RemoteAddr())
 			continue
@@ -41,13 +48,15 @@ func consumer(conn *websocket.Conn) {
 		log.Info("Received subscribe request from %v with offset %d.",
 			conn.RemoteAddr(), request.Offset)
 
-		subscription, err := broker.Subscribe(conn, request.Topic, request.Offset)
+		subscription, err := broker.Subscribe(conn, request.Topic, request.Partition,
+			request.Offset, request.Uncommitted)
 		if nil != err {
 			log.Error(err.Error())
+			websocket.JSON.Send(conn, &protocol.Ack{Status: protocol.StatusFailure})
 			continue
 		}
 
-		subscriptions[request.Topic] = subscription
+		subscriptions[key] = subscription
 		ack := protocol.Ack{Status: protocol.StatusSuccess}
 		websocket.JSON.Send(conn, &ack)
 
@@ -58,8 +67,8 @@ func consumer(conn *websocket.Conn) {
 	log.Info("Closed consumer connection from %v.", conn.RemoteAddr())
 
 	// delete all subscriptions
-	for topic, subscription := range subscriptions {
-		broker.Unsubscribe(topic, subscription)
+	for key, subscription := range subscriptions {
+		broker.Unsubscribe(key.topic, subscription)
 	}
 
 }
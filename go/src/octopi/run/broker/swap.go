@@ -2,44 +2,69 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
-	"hash/crc32"
+	"octopi/api/protocol"
 	"octopi/util/log"
 )
 
+// register handles rounds of leader election from the register. The broker
+// reports the state of its log of the partition, and waits for the register
+// to elect the candidate with the most up-to-date log. It acknowledges the
+// verdict with the role that it is about to take. Rounds that are superseded
+// by a later round are ignored.
 func register(ws *websocket.Conn) {
 
 	defer ws.Close()
 
 	log.Info("Received a leader change request from register")
 
-	var insyncSet map[string]bool
-	err := websocket.JSON.Receive(ws, &insyncSet)
+	var change protocol.LeaderChange
+	err := websocket.JSON.Receive(ws, &change)
 
 	// return if receive invalid message or if connection breaks
-	if nil != err || len(insyncSet) <= 0 {
+	if nil != err || len(change.Candidates) <= 0 {
 		log.Warn("Ignoring invalid list from register")
 		return
 	}
 
-	var max uint32 = 0
-	var maxhp string
+	if !broker.JoinElection(change.Partition, change.Generation) {
+		log.Warn("Ignoring stale round %d of election of %s.", change.Generation, change.Partition)
+		return
+	}
 
-	// deterministically determine the leader using the highest crc32 hash
-	for hp, _ := range insyncSet {
-		cksm := crc32.ChecksumIEEE([]byte(hp))
-		if cksm > max {
-			maxhp = hp
-			max = cksm
-		}
+	state := broker.LogState(change.Partition)
+	if err := websocket.JSON.Send(ws, &state); nil != err {
+		log.Warn("Unable to report log state to register: %s", err.Error())
+		return
+	}
+
+	var verdict protocol.LeaderChange
+	if err := websocket.JSON.Receive(ws, &verdict); nil != err || "" == verdict.Leader {
+		log.Warn("No leader of %s was elected.", change.Partition)
+		return
 	}
 
-	if maxhp == broker.Origin() {
-		log.Debug("I should become the new leader. I am %v", broker.Origin())
-		broker.BecomeLeader()
-		log.Debug("I am the new leader.")
+	ack := protocol.ElectionAck{Generation: change.Generation}
+	if verdict.Generation != change.Generation || !broker.LatestElection(change.Partition, change.Generation) {
+		log.Warn("Round %d of election of %s was superseded.", change.Generation, change.Partition)
+		websocket.JSON.Send(ws, &ack)
+		return
+	}
+
+	ack.Leader = verdict.Leader == broker.Origin()
+	if err := websocket.JSON.Send(ws, &ack); nil != err {
+		log.Warn("Unable to acknowledge election of %s: %s", change.Partition, err.Error())
+	}
+
+	if ack.Leader {
+		log.Debug("I should become the new leader of %s. I am %v", change.Partition, broker.Origin())
+		if err := broker.BecomeLeader(change.Partition); nil != err {
+			log.Warn("Got Error %v from BecomeLeader", err)
+			return
+		}
+		log.Debug("I am the new leader of %s.", change.Partition)
 	} else {
-		log.Debug("%v should become the new leader.", maxhp)
-		err := broker.ChangeLeader()
+		log.Debug("%v should become the new leader of %s.", verdict.Leader, change.Partition)
+		err := broker.ChangeLeader(change.Partition)
 		if nil != err {
 			log.Warn("Got Error %v from ChangeLeader", err)
 		}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// throttle handles requests to view or change the replication throttles at
+// runtime. Rates are given in bytes per second as query parameters of a POST,
+// e.g. /throttle?catch_up=1048576&replication=0. Omitted rates are left
+// unchanged, and rates that are not positive remove the limit. Requests without
+// rates leave the throttles alone. Responds with the rates now in effect.
+func throttle(w http.ResponseWriter, r *http.Request) {
+
+	catchUp, replication := broker.Throttles()
+	rates := map[string]*int64{"catch_up": &catchUp, "replication": &replication}
+	changed := false
+
+	for name, rate := range rates {
+		value := r.FormValue(name)
+		if "" == value {
+			continue
+		}
+		if http.MethodPost != r.Method {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if nil != err {
+			http.Error(w, fmt.Sprintf("Invalid %s: %s", name, value), http.StatusBadRequest)
+			return
+		}
+		*rate = n
+		changed = true
+	}
+
+	// plain views must not reset the throttles
+	if changed {
+		broker.SetThrottles(catchUp, replication)
+	}
+
+	fmt.Fprintf(w, "catch_up=%d replication=%d\n", catchUp, replication)
+
+}
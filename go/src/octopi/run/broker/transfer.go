@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"octopi/api/protocol"
+	"strconv"
+)
+
+// transfer handles requests to hand leadership of a partition led by this
+// broker to one of its in-sync followers, e.g. before restarting this broker.
+// The partition and follower are given as query parameters, e.g.
+// /transfer?topic=hello&partition=0&to=localhost:12346, and the request must be
+// a POST. Responds once the follower has caught up and the register has been
+// asked to elect it.
+func transfer(w http.ResponseWriter, r *http.Request) {
+
+	if http.MethodPost != r.Method {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	partition, err := strconv.Atoi(r.FormValue("partition"))
+	if nil != err {
+		partition = 0
+	}
+
+	name := protocol.PartitionName(r.FormValue("topic"), partition)
+	if err := broker.Transfer(name, r.FormValue("to")); nil != err {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	fmt.Fprintf(w, "transferred %s to %s\n", name, r.FormValue("to"))
+
+}
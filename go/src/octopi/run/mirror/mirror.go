@@ -0,0 +1,211 @@
+// mirror: command line tool that continuously copies topics from one cluster
+// to another. Each partition of each topic is subscribed to through the source
+// register, and republished to the same partition through the destination
+// register by a producer of its own. The offset of each message in the source
+// log is carried in its source-offset header, and as its ID.
+//
+// Progress is checkpointed per partition after each message is acknowledged
+// by the destination, so a restarted mirror resumes where it left off. If the
+// mirror dies between the acknowledgement and the checkpoint, the message is
+// sent again with the same ID, and the destination drops it as a resend of the
+// last message written to the partition. Destination brokers recover the last
+// message from their logs, so this holds across their restarts and failovers,
+// but not if another producer writes to the partition in between.
+//
+// Usage:
+//
+//	./mirror --source SRC --destination DST --topics T1,T2 [--partitions N]
+//	         [--checkpoints DIR]
+//
+// source:      host:port of the source cluster's register, or a comma-separated
+// list of its registers
+// destination: host:port of the destination cluster's register, or a
+// comma-separated list of its registers
+// topics:      comma separated list of topics to mirror
+// partitions:  number of partitions of each topic
+// checkpoints: directory to store checkpoints in
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"octopi/api/protocol"
+	"octopi/impl/producer"
+	"octopi/util/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Checkpoint file extension.
+const EXT = ".mirror"
+
+// Header holding the offset of a message in the source log.
+const OFFSET_HEADER = "source-offset"
+
+// mirror copies partitions from the source cluster to the destination.
+type mirror struct {
+	source      []string // host:ports of source registers
+	destination string   // host:port of destination register
+	checkpoints string   // checkpoint directory
+}
+
+// main launches a mirror instance
+func main() {
+
+	log.SetVerbose(log.INFO)
+	log.SetPrefix("mirror: ")
+
+	var source = flag.String("source", "localhost:12345", "host and port number of source register")
+	var destination = flag.String("destination", "localhost:12355", "host and port number of destination register")
+	var topics = flag.String("topics", "hello", "comma separated list of topics to mirror")
+	var partitions = flag.Int("partitions", 1, "number of partitions of each topic")
+	var checkpoints = flag.String("checkpoints", os.TempDir(), "directory to store checkpoints in")
+	flag.Parse()
+
+	m := &mirror{
+		source:      protocol.Registers(*source),
+		destination: *destination,
+		checkpoints: *checkpoints,
+	}
+
+	var wg sync.WaitGroup
+	for _, topic := range strings.Split(*topics, ",") {
+		for partition := 0; partition < *partitions; partition++ {
+			wg.Add(1)
+			go func(topic string, partition int) {
+				defer wg.Done()
+				m.copy(topic, partition)
+			}(topic, partition)
+		}
+	}
+
+	wg.Wait()
+
+}
+
+// copy subscribes to the given partition on the source cluster, starting from
+// the checkpoint, and republishes every message to the destination cluster.
+// Resubscribes if the source connection is lost.
+func (m *mirror) copy(topic string, partition int) {
+
+	name := protocol.PartitionName(topic, partition)
+	last, resumed := m.checkpoint(name)
+
+	// fixed producer ID, so that resent messages are recognized as duplicates
+	id := "mirror@" + m.source[0]
+	destination := producer.New(m.destination, &id)
+	defer destination.Close()
+
+	socket := &protocol.Socket{
+		HostPort:  m.source[0],
+		Path:      protocol.SUBSCRIBE,
+		Origin:    origin(),
+		Registers: m.source,
+	}
+
+	for {
+
+		request := &protocol.SubscribeRequest{Topic: topic, Partition: partition}
+		if resumed {
+			request.Offset = last
+		}
+
+		if _, err := socket.Send(request, math.MaxInt32, origin()); nil != err {
+			log.Warn("Unable to subscribe to %s: %s", name, err.Error())
+			socket.Reset(m.source[0])
+			continue
+		}
+
+		log.Info("Mirroring %s from offset %d.", name, request.Offset)
+
+		for {
+
+			var message protocol.Message
+			if err := socket.Receive(&message); nil != err {
+				log.Warn("Lost subscription to %s: %s", name, err.Error())
+				break
+			}
+
+			// the message at the checkpoint has already been mirrored
+			if resumed && message.ID <= last {
+				continue
+			}
+
+			headers := withOffset(message.Headers, message.ID)
+			if _, err := destination.SendID(topic, partition, message.ID, headers, message.Payload); nil != err {
+				log.Error("Unable to mirror %s: %s", name, err.Error())
+				break
+			}
+
+			last, resumed = message.ID, true
+			if err := m.save(name, last); nil != err {
+				log.Error("Unable to checkpoint %s: %s", name, err.Error())
+			}
+
+		}
+
+		socket.Reset(m.source[0])
+
+	}
+
+}
+
+// withOffset returns a copy of the given headers, along with the given source
+// offset.
+func withOffset(headers map[string]string, offset int64) map[string]string {
+	copied := map[string]string{OFFSET_HEADER: strconv.FormatInt(offset, 10)}
+	for key, value := range headers {
+		if OFFSET_HEADER != key {
+			copied[key] = value
+		}
+	}
+	return copied
+}
+
+// checkpoint returns the source offset of the last message of the given
+// partition that was mirrored, and true if there was one.
+func (m *mirror) checkpoint(name string) (int64, bool) {
+
+	data, err := ioutil.ReadFile(filepath.Join(m.checkpoints, name+EXT))
+	if nil != err {
+		return 0, false
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if nil != err {
+		log.Warn("Ignoring invalid checkpoint for %s.", name)
+		return 0, false
+	}
+
+	return offset, true
+
+}
+
+// save records the source offset of the last message of the given partition
+// that was mirrored. The checkpoint is replaced atomically, so that a crash
+// never leaves it half written.
+func (m *mirror) save(name string, offset int64) error {
+
+	path := filepath.Join(m.checkpoints, name+EXT)
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); nil != err {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+
+}
+
+// origin returns the origin of this mirror.
+func origin() string {
+	name, err := os.Hostname()
+	if nil != err {
+		log.Panic("%s", err.Error())
+	}
+	return "ws://" + name
+}
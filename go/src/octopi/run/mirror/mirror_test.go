@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"octopi/util/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckpoint ensures that checkpoints are saved and read back, and that
+// missing or invalid checkpoints are ignored.
+func TestCheckpoint(tester *testing.T) {
+
+	t := test.New(tester)
+
+	dir, err := ioutil.TempDir("", "mirror")
+	t.AssertNil(err, "ioutil.TempDir")
+	defer os.RemoveAll(dir)
+
+	m := &mirror{checkpoints: dir}
+	_, resumed := m.checkpoint("t#1")
+	t.AssertTrue(!resumed, "m.checkpoint")
+
+	t.AssertNil(m.save("t#1", 41), "m.save")
+	t.AssertNil(m.save("t#1", 82), "m.save")
+	offset, resumed := m.checkpoint("t#1")
+	t.AssertTrue(resumed, "m.checkpoint")
+	t.AssertEqual(new(test.IntMatcher), 82, int(offset))
+
+	err = ioutil.WriteFile(filepath.Join(dir, "t#2"+EXT), []byte("x"), 0644)
+	t.AssertNil(err, "ioutil.WriteFile")
+	_, resumed = m.checkpoint("t#2")
+	t.AssertTrue(!resumed, "m.checkpoint")
+
+}
+
+// TestWithOffset ensures that the source offset of a message is added to its
+// headers, replacing that of an earlier mirror, and that the headers of the
+// source message are kept.
+func TestWithOffset(tester *testing.T) {
+
+	t := test.New(tester)
+	matcher := new(test.StringMatcher)
+
+	source := map[string]string{OFFSET_HEADER: "7", "trace": "abc"}
+	headers := withOffset(source, 123)
+	t.AssertEqual(matcher, "123", headers[OFFSET_HEADER])
+	t.AssertEqual(matcher, "abc", headers["trace"])
+	t.AssertEqual(matcher, "7", source[OFFSET_HEADER])
+
+	headers = withOffset(nil, 0)
+	t.AssertEqual(matcher, "0", headers[OFFSET_HEADER])
+
+}
@@ -37,7 +37,7 @@ func pipe(p *producer.Producer, topic string) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		line, _ := reader.ReadBytes('\n')
-		if err := p.Send(topic, line); nil != err {
+		if _, err := p.Send(topic, line); nil != err {
 			log.Error("Gave up: %s", err.Error())
 			break
 		}
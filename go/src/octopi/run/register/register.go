@@ -1,112 +1,18 @@
 package main
 
 import (
-	"code.google.com/p/go.net/websocket"
 	"flag"
-	"io"
 	"net/http"
 	"octopi/api/protocol"
 	"octopi/impl/regimpl"
 	"octopi/util/config"
 	"octopi/util/log"
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 )
 
-var register *regimpl.Register
-var singleton chan int
-
-// leaderHandler handles brokers that are trying to initiate
-// leader connections with the register. Blocks connection
-// if there is already a leader
-func leaderHandler(ws *websocket.Conn) {
-
-	defer ws.Close()
-	// need to ensure that only one connection access at a time
-	select {
-	case <-singleton:
-		leaderChange(ws)
-		singleton <- 1
-	default:
-		//return directly if unavailable
-	}
-}
-
-func leaderChange(ws *websocket.Conn) {
-
-	var leaderhp protocol.HostPort
-	err := websocket.JSON.Receive(ws, &leaderhp)
-
-	log.Info("Received leader request from %v", leaderhp)
-
-	// close the connection if there is already a leader
-	if !register.NoLeader() {
-		return
-	}
-
-	if err == io.EOF {
-		register.SetLeader(regimpl.EMPTY)
-		log.Info("Leader %v has disconnected", leaderhp)
-		// XXX: is there a more elegant way? Seems a bit hacky
-		go register.CheckNewLeader()
-		return
-	}
-
-	log.Info("Made %v leader", leaderhp)
-
-	register.SetLeader(string(leaderhp))
-
-	for {
-		var change protocol.InsyncChange
-		err := websocket.JSON.Receive(ws, &change)
-
-		// leader has disconnected!
-		if err == io.EOF {
-			log.Info("Leader %v has disconnected", leaderhp)
-			register.SetLeader(regimpl.EMPTY)
-			// XXX: seems a bit hacky...
-			go register.CheckNewLeader()
-			return
-		}
-
-		if change.Type == protocol.ADD {
-			log.Info("Leader added an in-sync follower: %v", change.HostPort)
-			// add a new follower
-			register.AddFollower(string(change.HostPort))
-		} else if change.Type == protocol.REMOVE {
-			log.Info("Leader removed an in-sync follower: %v", change.HostPort)
-			// remove a follower
-			register.RemoveFollower(string(change.HostPort))
-		} else {
-			// ignore invalid message
-			log.Warn("Ignoring invalid message from %v", ws.RemoteAddr())
-			continue
-		}
-	}
-}
-
-// redirectHandler handles connections from new followers
-// joining the system or from producers wanting to publish
-// a topic. ACK the new follower/producer with a redirect
-// if a leader is determined. if not, disconnects.
-func redirectHandler(ws *websocket.Conn) {
-
-	defer ws.Close()
-
-	var redirect protocol.Ack
-
-	if register.NoLeader() {
-		redirect.Status = protocol.StatusNotReady
-		log.Info("We have no established leader now!")
-	} else {
-		redirect.Status = protocol.StatusRedirect
-		redirect.Payload = []byte(register.Leader())
-	}
-
-	log.Info("Redirect sending payload: %v", register.Leader())
-	// don't need to check if disconnect
-	websocket.JSON.Send(ws, redirect)
-}
-
 func main() {
 
 	log.SetVerbose(log.DEBUG)
@@ -126,19 +32,41 @@ func main() {
 	port, err := strconv.Atoi(config.Get("port", "12345"))
 	checkError(err)
 
-	register = regimpl.NewRegister()
+	timeout, err := strconv.Atoi(config.Get("session_timeout", "5000"))
+	checkError(err)
+	sessionTimeout := time.Duration(timeout) * time.Millisecond
 
-	singleton = make(chan int, 1)
-	singleton <- 1
+	// brokers not seen for this long are forgotten
+	expiry, err := strconv.Atoi(config.Get("broker_expiry", "86400000"))
+	checkError(err)
 
-	listenHttp(port)
-}
+	// the other registers in the register cluster, if any
+	id := config.Get("host", "localhost") + ":" + strconv.Itoa(port)
+	peers := make([]string, 0)
+	for _, hostport := range protocol.Registers(config.Get("registers", id)) {
+		if hostport != id {
+			peers = append(peers, hostport)
+		}
+	}
+
+	// state is written ahead to a journal in the data directory
+	dir, err := filepath.Abs(filepath.Join(config.Base, config.Get("data_dir", os.TempDir())))
+	checkError(err)
+	journal := filepath.Join(dir, "register-"+strconv.Itoa(port)+regimpl.JOURNAL_EXT)
+
+	log.Info("Starting register %s with peers %v.", id, peers)
+	register, err := regimpl.NewRegister(id, peers, journal)
+	checkError(err)
+
+	unclean, err := strconv.ParseBool(config.Get("unclean_election", "false"))
+	checkError(err)
+	register.SetUncleanElection(unclean)
+
+	if expiry > 0 {
+		go register.ExpireBrokers(time.Duration(expiry) * time.Millisecond)
+	}
 
-func listenHttp(port int) {
-	http.Handle("/"+protocol.LEADER, websocket.Handler(leaderHandler))
-	http.Handle("/"+protocol.FOLLOW, websocket.Handler(redirectHandler))
-	http.Handle("/"+protocol.PUBLISH, websocket.Handler(redirectHandler))
-	http.Handle("/"+protocol.SUBSCRIBE, websocket.Handler(redirectHandler))
+	regimpl.NewServer(register, sessionTimeout).Handle(http.DefaultServeMux)
 	http.ListenAndServe(":"+strconv.Itoa(port), nil)
 }
 
@@ -56,8 +56,8 @@ func sendMessages(conn *websocket.Conn, topic string, id string, msgCnt int) err
 
 	for i := 0; i < msgCnt; i++ {
 		seqmsg := []byte(strconv.Itoa(i))
-		msgToSend := protocol.Message{int64(i), seqmsg, crc32.ChecksumIEEE(seqmsg)}
-		req := protocol.ProduceRequest{id, topic, msgToSend}
+		msgToSend := protocol.Message{int64(i), seqmsg, crc32.ChecksumIEEE(seqmsg), nil}
+		req := protocol.ProduceRequest{id, topic, 0, msgToSend, nil}
 		err := websocket.JSON.Send(conn, req)
 
 		if err != nil {